@@ -2,4 +2,8 @@ module github.com/obase/kit
 
 go 1.14
 
-require github.com/obase/conf v1.10.7
+require (
+	github.com/andybalholm/brotli v1.1.0
+	github.com/obase/conf v1.10.7
+	golang.org/x/text v0.3.8
+)
@@ -2,15 +2,17 @@ package kit
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/obase/conf"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,9 +22,13 @@ const (
 	ProxyBufferPool_None = "none" // 没有缓存池
 	ProxyBufferPool_Sync = "sync" // 采用sync.Pool
 
-	ProxyErrorHandler_None = "none" // 没有错误处理
-	ProxyErrorHandler_Body = "body" // 将错误写到body
+	ProxyErrorHandler_None   = "none"   // 没有错误处理
+	ProxyErrorHandler_Body   = "body"   // 将错误写到body
+	ProxyErrorHandler_Status = "status" // 按错误类型返回状态码,不写body
+	ProxyErrorHandler_Json   = "json"   // 按错误类型返回状态码及application/problem+json,不包含错误细节
 
+	// 旧版本通过这些请求头传递代理目标,可被客户端伪造. 现改为通过context传递,
+	// 携带这些头的入站请求会被HttpProxy拒绝,出站请求中也会被删除
 	REVERSE_SCHEME = "x-rscheme"
 	REVERSE_HOST   = "x-rhost"
 	REVERSE_PATH   = "x-rpath"
@@ -169,8 +175,79 @@ type HttpConfig struct {
 
 	// ErrorHandler is an optional function that handles errors
 	// reaching the backend or errors from ModifyResponse.
-	// Values: none, body
+	// Values: none, body, status, json, or any name registered by
+	// RegisterProxyErrorHandler before SetupHttp/ReloadHttp; unknown names
+	// panic. status and json map timeouts to 504 and only log requests
+	// cancelled by the client. See ProxyErrorStatus.
 	ProxyErrorHandler string `json:"proxyErrorHandler" yaml:"proxyErrorHandler"`
+
+	// ReloadInterval, if positive, polls the conf package at this interval
+	// and reloads the http subsystem when the "http" section changes.
+	// Zero means no automatic reload, use ReloadHttp() manually.
+	ReloadInterval time.Duration `json:"reloadInterval" yaml:"reloadInterval"`
+
+	// TrackConnections, if true, wraps the dialer and transport to record
+	// per-host open, idle and in-use connections, dial failures and the
+	// time spent waiting for a connection. See HttpConnStats().
+	TrackConnections bool `json:"trackConnections" yaml:"trackConnections"`
+
+	// ErrorDecoders lists, in order, the names of the decoders HttpJson
+	// tries on non-2xx response bodies. The first one that matches turns
+	// the body into a *HttpProblem. Values: problem, codemsg, or any name
+	// registered by RegisterHttpErrorDecoder. Empty keeps returning HttpError.
+	ErrorDecoders []string `json:"errorDecoders" yaml:"errorDecoders"`
+
+	// Envelope describes the success envelope unwrapped by HttpJsonData,
+	// e.g. {"code":0,"msg":"","data":{...}}. Nil means the default shape.
+	Envelope *HttpEnvelope `json:"envelope" yaml:"envelope"`
+
+	// DisableCharsetDecode, if true, stops the helpers from transcoding
+	// non-UTF-8 response bodies (declared by BOM, Content-Type charset or
+	// html meta) to UTF-8.
+	DisableCharsetDecode bool `json:"disableCharsetDecode" yaml:"disableCharsetDecode"`
+
+	// ProxyAllowSchemes limits the upstream schemes ReverseProxy and
+	// HttpProxyHandler may forward to. Empty means any scheme.
+	ProxyAllowSchemes []string `json:"proxyAllowSchemes" yaml:"proxyAllowSchemes"`
+
+	// ProxyAllowHosts and ProxyAllowCIDRs form the upstream allowlist.
+	// A target is allowed if its host matches ProxyAllowHosts (exact or
+	// "*.example.com"), or its resolved address is in ProxyAllowCIDRs.
+	// Both empty means any host.
+	ProxyAllowHosts []string `json:"proxyAllowHosts" yaml:"proxyAllowHosts"`
+	ProxyAllowCIDRs []string `json:"proxyAllowCIDRs" yaml:"proxyAllowCIDRs"`
+
+	// ProxyDenyCIDRs are checked against the resolved upstream address at
+	// dial time and always win over the allowlist. ProxyDenyPrivate adds
+	// loopback, private, link-local and multicast ranges to the denylist.
+	// Disallowed targets get 403.
+	ProxyDenyCIDRs   []string `json:"proxyDenyCIDRs" yaml:"proxyDenyCIDRs"`
+	ProxyDenyPrivate bool     `json:"proxyDenyPrivate" yaml:"proxyDenyPrivate"`
+
+	// ProxyForwarded, if true, adds an RFC 7239 Forwarded header
+	// (for/host/proto) to proxied requests. ProxyXForwarded adds
+	// X-Forwarded-Host and X-Forwarded-Proto; X-Forwarded-For is always
+	// generated by httputil.ReverseProxy.
+	ProxyForwarded  bool `json:"proxyForwarded" yaml:"proxyForwarded"`
+	ProxyXForwarded bool `json:"proxyXForwarded" yaml:"proxyXForwarded"`
+
+	// ProxyTrustedCIDRs lists the client addresses whose inbound
+	// forwarding headers are kept and appended to. Headers from other
+	// clients are overwritten. Values: CIDRs or IPs, "*" for everyone,
+	// "none" for nobody. Empty means "*".
+	ProxyTrustedCIDRs []string `json:"proxyTrustedCIDRs" yaml:"proxyTrustedCIDRs"`
+
+	// ProxyRequestHeaders and ProxyResponseHeaders rewrite the headers of
+	// requests proxied by HttpProxy and of their responses. Handlers
+	// created by HttpProxyHandler use WithProxyRequestHeaders and
+	// WithProxyResponseHeaders instead.
+	ProxyRequestHeaders  *ProxyHeaderRules `json:"proxyRequestHeaders" yaml:"proxyRequestHeaders"`
+	ProxyResponseHeaders *ProxyHeaderRules `json:"proxyResponseHeaders" yaml:"proxyResponseHeaders"`
+
+	// ProxyCompress, if set, compresses the responses proxied by HttpProxy
+	// according to Accept-Encoding. Wrap other handlers with
+	// NewProxyCompressor(...).Handler instead.
+	ProxyCompress *ProxyCompressConfig `json:"proxyCompress" yaml:"proxyCompress"`
 }
 
 func SetupHttp(c *HttpConfig) {
@@ -199,13 +276,27 @@ func SetupHttp(c *HttpConfig) {
 	if c.ProxyErrorHandler == "" {
 		c.ProxyErrorHandler = ProxyErrorHandler_Body
 	}
-	ProxyFlushInterval = c.ProxyFlushInterval
-	HttpTransport = &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   c.ConnectTimeout,
-			KeepAlive: c.KeepAlive,
-		}).DialContext,
+	c.Envelope = c.Envelope.fill()
+	if len(c.ProxyTrustedCIDRs) == 0 {
+		c.ProxyTrustedCIDRs = []string{ProxyTrusted_All}
+	}
+
+	var base httpDialFunc = (&net.Dialer{
+		Timeout:   c.ConnectTimeout,
+		KeepAlive: c.KeepAlive,
+	}).DialContext
+	dial := base
+	if c.TrackConnections {
+		dial = trackHttpDial(base)
+	}
+
+	rt := new(httpRuntime)
+	rt.config = c
+	rt.guard = newProxyGuard(c)
+	rt.forwarding = newProxyForwarding(c)
+	rt.transport = &http.Transport{
+		Proxy:                  http.ProxyFromEnvironment,
+		DialContext:            dial,
 		ForceAttemptHTTP2:      IfBool(c.ForceAttemptHTTP2Set || c.ForceAttemptHTTP2, c.ForceAttemptHTTP2, true),
 		MaxIdleConns:           c.MaxIdleConns,
 		MaxIdleConnsPerHost:    c.MaxIdleConnsPerHost,
@@ -219,28 +310,77 @@ func SetupHttp(c *HttpConfig) {
 		WriteBufferSize:        c.WriteBufferSize,
 		ReadBufferSize:         c.ReadBufferSize,
 	}
-	HttpClient = &http.Client{
-		Transport: HttpTransport,
+	rt.roundTripper = rt.transport
+	if c.TrackConnections {
+		rt.roundTripper = httpTrackedTransport{RoundTripper: rt.transport}
+	}
+	rt.roundTripper = httpRuntimeTransport{RoundTripper: rt.roundTripper, rt: rt}
+	rt.client = &http.Client{
+		Transport: rt.roundTripper,
 		Timeout:   c.RequestTimeout,
 	}
 
-	ReverseProxy = &httputil.ReverseProxy{
-		Transport:     HttpTransport,
+	// 代理需要按解析后的地址做访问控制时使用独立的Transport,且不经过环境变量中的代理
+	rt.proxyTransport = rt.transport
+	if rt.guard.dialing() {
+		rt.proxyTransport = rt.transport.Clone()
+		rt.proxyTransport.Proxy = nil
+		rt.proxyTransport.DialContext = rt.guard.dial(base)
+		if c.TrackConnections {
+			rt.proxyTransport.DialContext = trackHttpDial(rt.proxyTransport.DialContext)
+		}
+	}
+	rt.proxyRoundTripper = rt.proxyTransport
+	if c.TrackConnections {
+		rt.proxyRoundTripper = httpTrackedTransport{RoundTripper: rt.proxyRoundTripper}
+	}
+	if rt.guard.enabled() {
+		rt.proxyRoundTripper = proxyGuardTransport{guard: rt.guard, RoundTripper: rt.proxyRoundTripper}
+	}
+	rt.proxyRoundTripper = proxyRejectTransport{RoundTripper: rt.proxyRoundTripper}
+	rt.proxyRoundTripper = httpRuntimeTransport{RoundTripper: rt.proxyRoundTripper, rt: rt}
+
+	var pheaders []ProxyOption
+	if c.ProxyRequestHeaders != nil {
+		pheaders = append(pheaders, WithProxyRequestHeaders(*c.ProxyRequestHeaders))
+	}
+	if c.ProxyResponseHeaders != nil {
+		pheaders = append(pheaders, WithProxyResponseHeaders(*c.ProxyResponseHeaders))
+	}
+	popts := newProxyOptions(pheaders...)
+	rt.proxy = &httputil.ReverseProxy{
+		Transport:     rt.proxyRoundTripper,
 		FlushInterval: c.ProxyFlushInterval,
 		Director: func(req *http.Request) {
-			req.URL.Scheme = req.Header.Get(REVERSE_SCHEME)
-			req.URL.Host = req.Header.Get(REVERSE_HOST)
-			req.URL.Path = req.Header.Get(REVERSE_PATH)
-			if _, ok := req.Header["User-Agent"]; !ok {
-				// explicitly disable User-Agent so it's not set to  value
-				req.Header.Set("User-Agent", "")
-			}
+			popts.direct(req, ProxyTarget(req))
 		},
-		BufferPool:   proxyBufferPool(c.ProxyBufferPool),
-		ErrorHandler: proxyErrorHandler(c.ProxyErrorHandler),
+		ModifyResponse: popts.modifyResponse,
+		BufferPool:     proxyBufferPool(c.ProxyBufferPool),
+		ErrorHandler:   proxyErrorHandler(c.ProxyErrorHandler),
+	}
+	rt.proxyHandler = rt.proxy
+	if c.ProxyCompress != nil {
+		rt.proxyHandler = NewProxyCompressor(*c.ProxyCompress).Handler(rt.proxy)
+	}
+
+	httpMutex.Lock()
+	old, _ := httpCurrent.Load().(*httpRuntime)
+	httpCurrent.Store(rt)
+	httpMutex.Unlock()
+	httpLegacyOnce.Do(setupHttpLegacy)
+
+	if old != nil {
+		closeHttpRuntime(old)
 	}
 }
 
+/*
+旧版本变量,仅在首次SetupHttp时赋值,之后不再改写,可以并发读取.
+HttpClient与ReverseProxy总是转发给当前的Transport,但超时及FlushInterval等为首次配置的值;
+HttpTransport为首次配置的Transport. 需要运行期重载的配置请使用GetHttpClient()等方法.
+
+Deprecated: 使用GetHttpTransport/GetHttpClient/GetReverseProxy/GetHttpConfig
+*/
 var (
 	HttpTransport      *http.Transport
 	HttpClient         *http.Client
@@ -248,6 +388,90 @@ var (
 	ProxyFlushInterval time.Duration
 )
 
+var httpLegacyOnce sync.Once
+
+func setupHttpLegacy() {
+	rt := currentHttp()
+	HttpTransport = rt.transport
+	HttpClient = &http.Client{
+		Transport: httpDynamicTransport{},
+		Timeout:   rt.client.Timeout,
+	}
+	ReverseProxy = &httputil.ReverseProxy{
+		Transport:     httpDynamicProxyTransport{},
+		FlushInterval: rt.proxy.FlushInterval,
+		Director: func(req *http.Request) {
+			currentHttp().proxy.Director(req)
+		},
+		ModifyResponse: func(rsp *http.Response) error {
+			return currentHttp().proxy.ModifyResponse(rsp)
+		},
+		BufferPool:   rt.proxy.BufferPool,
+		ErrorHandler: httpDynamicErrorHandler,
+	}
+	ProxyFlushInterval = rt.proxy.FlushInterval
+}
+
+type httpRuntime struct {
+	active  int64 // 经由该运行时发出且未结束的请求数,atomic操作,放在开头保证32位平台的对齐
+	retired int32 // 已被新的运行时替换
+
+	config            *HttpConfig
+	transport         *http.Transport
+	roundTripper      http.RoundTripper // transport或其统计包装
+	client            *http.Client
+	guard             *proxyGuard
+	forwarding        *proxyForwarding
+	proxyTransport    *http.Transport   // 启用拨号检查时独立于transport
+	proxyRoundTripper http.RoundTripper // proxyTransport或其统计/访问控制包装
+	proxy             *httputil.ReverseProxy
+	proxyHandler      http.Handler // proxy或其压缩包装
+}
+
+var (
+	httpMutex   sync.Mutex
+	httpCurrent atomic.Value // *httpRuntime
+)
+
+func currentHttp() *httpRuntime {
+	return httpCurrent.Load().(*httpRuntime)
+}
+
+func GetHttpConfig() HttpConfig {
+	return *currentHttp().config
+}
+
+func GetHttpTransport() *http.Transport {
+	return currentHttp().transport
+}
+
+func GetHttpClient() *http.Client {
+	return currentHttp().client
+}
+
+func GetReverseProxy() *httputil.ReverseProxy {
+	return currentHttp().proxy
+}
+
+// 总是转发给当前的HttpTransport,避免重载后仍使用旧连接池
+type httpDynamicTransport struct{}
+
+func (httpDynamicTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return currentHttp().roundTripper.RoundTrip(req)
+}
+
+// 代理总是转发给当前的proxyTransport
+type httpDynamicProxyTransport struct{}
+
+func (httpDynamicProxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return currentHttp().proxyRoundTripper.RoundTrip(req)
+}
+
+// 总是使用当前ReverseProxy的ErrorHandler
+func httpDynamicErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	currentHttp().proxy.ErrorHandler(w, r, err)
+}
+
 type HttpError string
 
 func (h HttpError) Error() string {
@@ -282,12 +506,22 @@ func proxyBufferPool(name string) httputil.BufferPool {
 func proxyErrorHandler(name string) func(w http.ResponseWriter, r *http.Request, err error) {
 	switch name {
 	case ProxyErrorHandler_None:
-		return nil
+		return proxyGuardErrorHandler(nil)
 	case ProxyErrorHandler_Body:
-		return func(w http.ResponseWriter, r *http.Request, err error) {
+		return proxyGuardErrorHandler(func(w http.ResponseWriter, r *http.Request, err error) {
 			w.WriteHeader(http.StatusBadGateway)
 			fmt.Fprintf(w, " proxy error: %v", err)
-		}
+		})
+	case ProxyErrorHandler_Status:
+		return proxyStatusErrorHandler
+	case ProxyErrorHandler_Json:
+		return proxyJsonErrorHandler
+	}
+	if handler := getProxyErrorHandler(name); handler != nil {
+		return handler
+	}
+	if httpInitializing {
+		return lazyProxyErrorHandler(name)
 	}
 	panic("invalid proxy error handler type: " + name)
 }
@@ -315,51 +549,64 @@ func JoinQuery(rurl string, params map[string]string) string {
 }
 
 func HttpRawRequest(method string, url string, header map[string]string, body io.Reader) (state int, content string, err error) {
+	return HttpDo(method, url, body, WithHttpHeaderMap(header))
+}
 
-	// 创建请求
-	req, err := http.NewRequest(method, url, body)
-	if err != nil {
-		return
-	}
+// 适用于大多数情况下的ContentType都是application/json,如果不需要请用HttpRawRequest
+func HttpRequest(method string, url string, header map[string]string, body io.Reader) (state int, content string, err error) {
+	o := newHttpOptions(WithHttpHeaderMap(header))
+	o.defContentType = "application/json"
+	state, _, content, err = httpRequest(method, url, body, o)
+	return
+}
 
-	for k, v := range header {
-		req.Header.Set(k, v)
+func HttpJson(method string, url string, header map[string]string, reqobj interface{}, rspobj interface{}) (status int, err error) {
+	return HttpDoJson(method, url, reqobj, rspobj, WithHttpHeaderMap(header))
+}
+
+// o.timing不为nil或设置了HttpTimingHook时才会记录耗时
+func httpRequest(method string, rurl string, body io.Reader, o *httpOptions) (state int, rheader http.Header, content string, err error) {
+	ctx := o.ctx
+	if o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
 	}
-	rsp, err := HttpClient.Do(req)
-	if err != nil {
-		return
+	if len(o.query) > 0 {
+		rurl = joinQueryValues(rurl, o.query)
 	}
-	defer rsp.Body.Close()
-
-	state = rsp.StatusCode
-	buf := GetBytesBufferN(HTTP_BLOCK_SIZE)
-	bss := GetBlockBufferN(HTTP_BLOCK_SIZE)
-	if _, err = io.CopyBuffer(buf, rsp.Body, bss); err == nil {
-		content = buf.String()
+	if body != nil && o.requestCharset != "" {
+		if body, err = encodeHttpCharset(o.requestCharset, body); err != nil {
+			return
+		}
 	}
-	PutBlockBuffer(bss)
-	PutBytesBuffer(buf)
-	return
-}
-
-// 适用于大多数情况下的ContentType都是application/json,如果不需要请用HttpRawRequest
-func HttpRequest(method string, url string, header map[string]string, body io.Reader) (state int, content string, err error) {
 	// 创建请求
-	req, err := http.NewRequest(method, url, body)
+	req, err := http.NewRequestWithContext(ctx, method, rurl, body)
 	if err != nil {
 		return
 	}
-	req.Header.Set("Content-Type", "application/json")
-	for k, v := range header {
-		req.Header.Set(k, v)
+	o.apply(req)
+	if hook := getHttpTimingHook(); o.timing != nil || hook != nil {
+		timer := newHttpTimer()
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), timer.trace()))
+		defer func() {
+			ret := timer.done()
+			if o.timing != nil {
+				*o.timing = ret
+			}
+			if hook != nil {
+				hook(req, state, &ret)
+			}
+		}()
 	}
-	rsp, err := HttpClient.Do(req)
+	rsp, err := GetHttpClient().Do(req)
 	if err != nil {
 		return
 	}
 	defer rsp.Body.Close()
 
 	state = rsp.StatusCode
+	rheader = rsp.Header
 	buf := GetBytesBufferN(HTTP_BLOCK_SIZE)
 	bss := GetBlockBufferN(HTTP_BLOCK_SIZE)
 	if _, err = io.CopyBuffer(buf, rsp.Body, bss); err == nil {
@@ -367,10 +614,13 @@ func HttpRequest(method string, url string, header map[string]string, body io.Re
 	}
 	PutBlockBuffer(bss)
 	PutBytesBuffer(buf)
+	if err == nil && o.decodeCharset {
+		content, err = decodeHttpCharset(rheader, content)
+	}
 	return
 }
 
-func HttpJson(method string, url string, header map[string]string, reqobj interface{}, rspobj interface{}) (status int, err error) {
+func httpJson(method string, rurl string, reqobj interface{}, rspobj interface{}, o *httpOptions) (status int, err error) {
 	var body io.Reader
 	if reqobj != nil {
 		var data []byte
@@ -380,12 +630,16 @@ func HttpJson(method string, url string, header map[string]string, reqobj interf
 		}
 		body = bytes.NewReader(data)
 	}
-	status, content, err := HttpRequest(method, url, header, body)
+	status, rheader, content, err := httpRequest(method, rurl, body, o)
 	if err != nil {
 		return
 	}
-	if status < 200 || status > 299 {
-		err = HttpError(content)
+	if o.envelopeSet {
+		if err = unwrapHttpEnvelope(o.envelope, status, content, rspobj); err == nil && (status < 200 || status > 299) {
+			err = decodeHttpErrorWith(o.errorDecoders, status, rheader, content)
+		}
+	} else if status < 200 || status > 299 {
+		err = decodeHttpErrorWith(o.errorDecoders, status, rheader, content)
 	} else {
 		err = json.Unmarshal([]byte(content), &rspobj)
 	}
@@ -393,12 +647,19 @@ func HttpJson(method string, url string, header map[string]string, reqobj interf
 }
 
 func HttpProxy(rurl string, writer http.ResponseWriter, request *http.Request) (err error) {
+	if hasReverseHeader(request.Header) {
+		err = ErrProxyReverseHeader
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte(err.Error()))
+		return
+	}
 	purl, err := url.Parse(rurl)
 	if err == nil {
-		request.Header.Set(REVERSE_SCHEME, purl.Scheme)
-		request.Header.Set(REVERSE_HOST, purl.Host)
-		request.Header.Set(REVERSE_PATH, purl.Path)
-		ReverseProxy.ServeHTTP(writer, request)
+		if _, err = currentHttp().guard.checkURL(purl); err != nil {
+			writer.WriteHeader(http.StatusForbidden)
+			return
+		}
+		currentHttp().proxyHandler.ServeHTTP(writer, WithProxyTarget(request, purl))
 	} else {
 		writer.WriteHeader(http.StatusBadGateway)
 		writer.Write([]byte(err.Error()))
@@ -406,32 +667,41 @@ func HttpProxy(rurl string, writer http.ResponseWriter, request *http.Request) (
 	return
 }
 
-func HttpProxyHandler(rurl string) *httputil.ReverseProxy {
+// 默认用rurl的路径替换入站路径,可通过WithProxyPathJoin等选项改写
+func HttpProxyHandler(rurl string, opts ...ProxyOption) *httputil.ReverseProxy {
 	purl, _ := url.Parse(rurl)
+	return newProxyHandler(newProxyOptions(opts...), purl)
+}
+
+// target为nil时从请求的context中读取代理目标,context中携带的代理选项优先于o
+func newProxyHandler(o *proxyOptions, target *url.URL) *httputil.ReverseProxy {
 	return &httputil.ReverseProxy{
-		Transport:     HttpTransport,
-		FlushInterval: ProxyFlushInterval,
+		Transport:     httpDynamicProxyTransport{},
+		FlushInterval: GetHttpConfig().ProxyFlushInterval,
 		Director: func(req *http.Request) {
-			req.URL.Scheme = purl.Scheme
-			req.URL.Host = purl.Host
-			req.URL.Path = purl.Path
-			if _, ok := req.Header["User-Agent"]; !ok {
-				// explicitly disable User-Agent so it's not set to default value
-				req.Header.Set("User-Agent", "")
+			if target != nil {
+				proxyOptionsOf(req, o).direct(req, target)
+			} else {
+				proxyOptionsOf(req, o).direct(req, ProxyTarget(req))
 			}
 		},
-		BufferPool:   ReverseProxy.BufferPool,
-		ErrorHandler: ReverseProxy.ErrorHandler,
+		ModifyResponse: func(rsp *http.Response) error {
+			return proxyOptionsOf(rsp.Request, o).modifyResponse(rsp)
+		},
+		BufferPool:   GetReverseProxy().BufferPool,
+		ErrorHandler: httpDynamicErrorHandler,
 	}
 }
 
+// 包初始化期间,见lazyProxyErrorHandler
+var httpInitializing bool
+
 func init() {
-	var c *HttpConfig
-	if cnf, ok := conf.Get(HTTP_CKEY); ok {
-		if err := conf.Convert(cnf, &c); err == nil {
-			_, c.DisableCompressionSet = conf.Elem(cnf, "disableCompression")
-			_, c.ForceAttemptHTTP2Set = conf.Elem(cnf, "forceAttemptHTTP2")
-		}
-	}
+	c, _, _ := loadHttpConfig()
+	httpInitializing = true
 	SetupHttp(c)
+	httpInitializing = false
+	if ri := GetHttpConfig().ReloadInterval; ri > 0 {
+		WatchHttp(ri)
+	}
 }
@@ -1,7 +1,383 @@
 package kit
 
-import "testing"
+import (
+	"context"
+	"fmt"
+	"github.com/obase/conf"
+	"golang.org/x/text/encoding/htmlindex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestHttpJson(t *testing.T) {
 
 }
+
+func TestHttpJsonBatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, `{"path":%q}`, r.URL.Path)
+	}))
+	defer srv.Close()
+
+	type result struct {
+		Path string `json:"path"`
+	}
+	reqs := make([]*HttpBatchRequest, 10)
+	for i := range reqs {
+		reqs[i] = &HttpBatchRequest{Method: http.MethodGet, Url: fmt.Sprintf("%s/%d", srv.URL, i), Response: new(result)}
+	}
+	rets := HttpJsonBatch(3, false, reqs...)
+	for i, ret := range rets {
+		if ret.Err != nil || ret.Status != http.StatusOK {
+			t.Fatalf("request %d: status=%d err=%v", i, ret.Status, ret.Err)
+		}
+		if path := reqs[i].Response.(*result).Path; path != fmt.Sprintf("/%d", i) {
+			t.Fatalf("request %d: unexpected path %s", i, path)
+		}
+	}
+
+	reqs = []*HttpBatchRequest{{Method: http.MethodGet, Url: srv.URL + "/fail"}}
+	for i := 0; i < 20; i++ {
+		reqs = append(reqs, &HttpBatchRequest{Method: http.MethodGet, Url: srv.URL + "/ok", Response: new(result)})
+	}
+	rets = HttpJsonBatch(1, true, reqs...)
+	if rets[0].Err == nil {
+		t.Fatal("expected error for first request")
+	}
+	if rets[len(rets)-1].Err != context.Canceled {
+		t.Fatalf("expected last request canceled, got %v", rets[len(rets)-1].Err)
+	}
+}
+
+func TestReloadHttp(t *testing.T) {
+	defer SetupHttp(nil)
+
+	old := GetHttpTransport()
+	conf.Setup(map[string]interface{}{HTTP_CKEY: map[string]interface{}{"requestTimeout": "3s"}})
+	defer conf.Setup(map[string]interface{}{HTTP_CKEY: nil})
+	if err := ReloadHttp(); err != nil {
+		t.Fatal(err)
+	}
+	if GetHttpClient().Timeout != 3*time.Second {
+		t.Fatalf("unexpected timeout: %v", GetHttpClient().Timeout)
+	}
+	if GetHttpTransport() == old {
+		t.Fatal("transport not replaced")
+	}
+	if HttpClient == GetHttpClient() || ReverseProxy == GetReverseProxy() {
+		t.Fatal("legacy variables should not be reassigned on reload")
+	}
+
+	conf.Setup(map[string]interface{}{HTTP_CKEY: map[string]interface{}{"proxyBufferPool": "unknown"}})
+	if err := ReloadHttp(); err == nil {
+		t.Fatal("expected error for invalid config")
+	}
+	if GetHttpClient().Timeout != 3*time.Second {
+		t.Fatal("invalid config should keep the previous setup")
+	}
+
+	conf.Setup(map[string]interface{}{HTTP_CKEY: map[string]interface{}{"requestTimeout": []interface{}{"bad"}}})
+	if err := ReloadHttp(); err == nil {
+		t.Fatal("expected error for malformed config")
+	}
+	if GetHttpClient().Timeout != 3*time.Second {
+		t.Fatal("malformed config should keep the previous setup")
+	}
+}
+
+func TestReloadHttpCloseRetired(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	defer SetupHttp(nil)
+
+	SetupHttp(&HttpConfig{TrackConnections: true})
+	old := GetHttpClient()
+	SetupHttp(&HttpConfig{TrackConnections: true})
+	// 重载后仍经由旧运行时发出的请求,其连接归还后应在请求结束时被关闭
+	rsp, err := old.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	open := func() int64 {
+		for _, s := range HttpConnStats() {
+			if s.Host == host {
+				return s.Open
+			}
+		}
+		return 0
+	}
+	if open() != 1 {
+		t.Fatalf("unexpected open connections: %d", open())
+	}
+	deadline := time.Now().Add(HTTP_RELOAD_SETTLE + 2*time.Second)
+	for open() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("retired connection not closed: %d open", open())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestHttpRequestTiming(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	var hooked int
+	SetHttpTimingHook(func(req *http.Request, state int, timing *HttpTiming) {
+		hooked++
+	})
+	defer SetHttpTimingHook(nil)
+
+	_, _, timing, err := HttpRequestTiming(http.MethodGet, srv.URL, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timing.Reused || timing.FirstByte < 10*time.Millisecond || timing.Total < timing.FirstByte {
+		t.Fatalf("unexpected timing: %+v", timing)
+	}
+	if _, _, timing, err = HttpRequestTiming(http.MethodGet, srv.URL, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !timing.Reused {
+		t.Fatalf("expected reused connection: %+v", timing)
+	}
+	if hooked != 2 {
+		t.Fatalf("expected hook called twice, got %d", hooked)
+	}
+}
+
+func TestHttpConnStats(t *testing.T) {
+	SetupHttp(&HttpConfig{TrackConnections: true})
+	defer SetupHttp(nil)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := HttpRequest(http.MethodGet, srv.URL, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	host := strings.TrimPrefix(srv.URL, "http://")
+	for _, s := range HttpConnStats() {
+		if s.Host == host {
+			if s.Dials != 1 || s.Open != 1 || s.Idle != 1 || s.InUse != 0 {
+				t.Fatalf("unexpected stats: %+v", s)
+			}
+			return
+		}
+	}
+	t.Fatalf("missing stats for %s", host)
+}
+
+func TestHttpConnStatsProxy(t *testing.T) {
+	// 经由代理时拨号与占用连接都按同一地址统计
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.String()))
+	}))
+	defer proxy.Close()
+	purl, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: httpTrackedTransport{RoundTripper: &http.Transport{
+		Proxy:       http.ProxyURL(purl),
+		DialContext: trackHttpDial((&net.Dialer{}).DialContext),
+	}}}
+	for i := 0; i < 2; i++ {
+		rsp, err := client.Get("http://kit.test/stats")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+	}
+	var found bool
+	for _, s := range HttpConnStats() {
+		switch s.Host {
+		case purl.Host:
+			found = true
+			if s.Dials != 1 || s.Open != 1 || s.Idle != 1 || s.InUse != 0 {
+				t.Fatalf("unexpected stats: %+v", s)
+			}
+		case "kit.test:80":
+			t.Fatalf("unexpected stats for target: %+v", s)
+		}
+	}
+	if !found {
+		t.Fatalf("missing stats for %s", purl.Host)
+	}
+}
+
+func TestHttpJsonErrorDecoders(t *testing.T) {
+	SetupHttp(&HttpConfig{ErrorDecoders: []string{HttpErrorDecoder_Problem, HttpErrorDecoder_CodeMsg}})
+	defer SetupHttp(nil)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/problem":
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"type":"https://example.com/probs/out-of-credit","title":"You do not have enough credit.","balance":30}`))
+		case "/codemsg":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"code":1001,"msg":"invalid param"}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("internal error"))
+		}
+	}))
+	defer srv.Close()
+
+	_, err := HttpJson(http.MethodGet, srv.URL+"/problem", nil, nil, nil)
+	if p, ok := err.(*HttpProblem); !ok || p.Status != http.StatusForbidden || p.Title != "You do not have enough credit." || p.Extensions["balance"] != float64(30) {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+	_, err = HttpJson(http.MethodGet, srv.URL+"/codemsg", nil, nil, nil)
+	if p, ok := err.(*HttpProblem); !ok || p.Code != "1001" || p.Message != "invalid param" {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+	_, err = HttpJson(http.MethodGet, srv.URL+"/raw", nil, nil, nil)
+	if err != HttpError("internal error") {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+}
+
+func TestHttpJsonData(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			w.Write([]byte(`{"code":0,"msg":"","data":{"name":"kit"}}`))
+		case "/fail":
+			w.Write([]byte(`{"code":"E100","msg":"not found"}`))
+		case "/custom":
+			w.Write([]byte(`{"errno":200,"result":{"name":"custom"}}`))
+		}
+	}))
+	defer srv.Close()
+
+	var v struct {
+		Name string `json:"name"`
+	}
+	if _, err := HttpJsonData(http.MethodGet, srv.URL+"/ok", nil, nil, &v); err != nil || v.Name != "kit" {
+		t.Fatalf("name=%s err=%v", v.Name, err)
+	}
+	_, err := HttpJsonData(http.MethodGet, srv.URL+"/fail", nil, nil, &v)
+	if p, ok := err.(*HttpProblem); !ok || p.Code != "E100" || p.Message != "not found" || p.Status != http.StatusOK {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+	env := &HttpEnvelope{CodeField: "errno", DataField: "result", OkCodes: []string{"200"}}
+	if _, err := HttpJsonEnvelope(env, http.MethodGet, srv.URL+"/custom", nil, nil, &v); err != nil || v.Name != "custom" {
+		t.Fatalf("name=%s err=%v", v.Name, err)
+	}
+}
+
+func TestHttpDoOptions(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		fmt.Fprintf(w, `{"host":%q,"accept":%q,"query":%q,"auth":%q,"contentType":%q}`,
+			r.Host, strings.Join(r.Header["Accept"], ","), r.URL.RawQuery, user+":"+pass, r.Header.Get("Content-Type"))
+	}))
+	defer srv.Close()
+
+	var v struct {
+		Host        string `json:"host"`
+		Accept      string `json:"accept"`
+		Query       string `json:"query"`
+		Auth        string `json:"auth"`
+		ContentType string `json:"contentType"`
+	}
+	_, err := HttpDoJson(http.MethodGet, srv.URL+"?a=1", nil, &v,
+		WithHttpHeader("Accept", "text/plain"),
+		WithHttpHeader("Accept", "application/json"),
+		WithHttpHost("example.com"),
+		WithHttpBasicAuth("user", "pass"),
+		WithHttpQuery("b", "2"),
+		WithHttpTimeout(time.Second),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Host != "example.com" || v.Accept != "text/plain,application/json" || v.Query != "a=1&b=2" || v.Auth != "user:pass" || v.ContentType != "application/json" {
+		t.Fatalf("unexpected request: %+v", v)
+	}
+
+	if _, err = HttpDoJson(http.MethodGet, srv.URL, nil, &v, WithHttpContentType("text/xml")); err != nil || v.ContentType != "text/xml" {
+		t.Fatalf("contentType=%s err=%v", v.ContentType, err)
+	}
+	if _, err = HttpJson(http.MethodGet, srv.URL, map[string]string{"Content-Type": "text/csv"}, nil, &v); err != nil || v.ContentType != "text/csv" {
+		t.Fatalf("contentType=%s err=%v", v.ContentType, err)
+	}
+}
+
+func TestHttpCharset(t *testing.T) {
+	gbk, _ := htmlindex.Get("gbk")
+	var length int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/echo":
+			data, _ := ioutil.ReadAll(r.Body)
+			w.Header().Set("Content-Type", r.Header.Get("Content-Type"))
+			length = r.ContentLength
+			w.Write(data)
+			return
+		case "/redirect":
+			http.Redirect(w, r, "/echo", http.StatusTemporaryRedirect)
+			return
+		case "/binary":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write([]byte{0xFF, 0xFE, 0x00, 0xD8, 0x01})
+			return
+		case "/utf16":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte{0xFF, 0xFE, 'o', 0, 'k', 0})
+			return
+		}
+		data, _ := gbk.NewEncoder().String(`{"name":"中文"}`)
+		w.Header().Set("Content-Type", "application/json; charset=GBK")
+		w.Write([]byte(data))
+	}))
+	defer srv.Close()
+
+	var v struct {
+		Name string `json:"name"`
+	}
+	if _, err := HttpJson(http.MethodGet, srv.URL, nil, nil, &v); err != nil || v.Name != "中文" {
+		t.Fatalf("name=%s err=%v", v.Name, err)
+	}
+	_, content, err := HttpDo(http.MethodGet, srv.URL, nil, WithHttpDecodeCharset(false))
+	if err != nil || content == `{"name":"中文"}` {
+		t.Fatalf("expected raw gbk content, err=%v", err)
+	}
+	// 请求以gbk发送,响应回显同样的Content-Type,自动解码后应还原
+	// 编码后的body有确定的长度,307重定向时可以重发
+	_, content, err = HttpDo(http.MethodPost, srv.URL+"/redirect", strings.NewReader("中文"), WithHttpContentType("text/plain"), WithHttpRequestCharset("gbk"))
+	if err != nil || content != "中文" || length != 4 {
+		t.Fatalf("content=%s length=%d err=%v", content, length, err)
+	}
+	// 只有文本类型按BOM转码
+	if _, content, err = HttpDo(http.MethodGet, srv.URL+"/binary", nil); err != nil || content != "\xff\xfe\x00\xd8\x01" {
+		t.Fatalf("binary body should not be decoded: %q err=%v", content, err)
+	}
+	if _, content, err = HttpDo(http.MethodGet, srv.URL+"/utf16", nil); err != nil || content != "ok" {
+		t.Fatalf("content=%q err=%v", content, err)
+	}
+}
@@ -0,0 +1,74 @@
+package kit
+
+import (
+	"context"
+	"sync"
+)
+
+const HTTP_BATCH_PARALLEL = 8 // 默认并发数
+
+type HttpBatchRequest struct {
+	Method   string
+	Url      string
+	Header   map[string]string
+	Request  interface{} // 请求对象,序列化为json
+	Response interface{} // 响应对象,必须是指针
+	Options  []HttpOption
+}
+
+type HttpBatchResult struct {
+	Status int
+	Err    error
+}
+
+/*
+批量执行HttpJson请求:
+1. parallel为最大并发数,小于等于0则使用HTTP_BATCH_PARALLEL
+2. 结果与reqs一一对应,顺序一致
+3. failFast为true时,任一请求失败即取消其余请求,尚未执行的请求Err为context.Canceled,执行中的请求会被中断
+*/
+func HttpJsonBatch(parallel int, failFast bool, reqs ...*HttpBatchRequest) []*HttpBatchResult {
+	return HttpJsonBatchContext(context.Background(), parallel, failFast, reqs...)
+}
+
+func HttpJsonBatchContext(ctx context.Context, parallel int, failFast bool, reqs ...*HttpBatchRequest) []*HttpBatchResult {
+	if parallel <= 0 {
+		parallel = HTTP_BATCH_PARALLEL
+	}
+	if parallel > len(reqs) {
+		parallel = len(reqs)
+	}
+	rets := make([]*HttpBatchResult, len(reqs))
+	if len(reqs) == 0 {
+		return rets
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var once sync.Once
+	p := Parallel(parallel)
+	defer p.Close()
+
+	for i, r := range reqs {
+		ret := new(HttpBatchResult)
+		rets[i] = ret
+		p.Add(func(r *HttpBatchRequest, ret *HttpBatchResult) func() {
+			return func() {
+				if ret.Err = ctx.Err(); ret.Err != nil {
+					return
+				}
+				o := newHttpOptions(r.Options...)
+				o.ctx = ctx
+				o.setHeaderMap(r.Header)
+				o.defContentType = "application/json"
+				ret.Status, ret.Err = httpJson(r.Method, r.Url, r.Request, r.Response, o)
+				if ret.Err != nil && failFast {
+					once.Do(cancel)
+				}
+			}
+		}(r, ret))
+	}
+	p.Wait()
+	return rets
+}
@@ -0,0 +1,144 @@
+package kit
+
+import (
+	"bytes"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const HTTP_CHARSET_SNIFF_SIZE = 1024 // 在html前1024字节内查找meta声明
+
+var (
+	httpBomUTF8     = []byte{0xEF, 0xBB, 0xBF}
+	httpBomUTF16LE  = []byte{0xFF, 0xFE}
+	httpBomUTF16BE  = []byte{0xFE, 0xFF}
+	httpMetaCharset = regexp.MustCompile(`(?i)<meta[^>]+charset\s*=\s*["']?\s*([a-zA-Z0-9_:.\-]+)`)
+)
+
+/*
+判断响应的字符集,只处理文本类型或声明了charset参数的响应,依次为:
+1. BOM
+2. Content-Type的charset参数
+3. html中的<meta charset>或<meta http-equiv="Content-Type">
+未声明时返回空字符串,不做猜测. 二进制响应(如application/octet-stream)即使以BOM开头也不转码
+*/
+func httpCharsetOf(contentType string, body []byte) string {
+	mt, params, _ := mime.ParseMediaType(contentType)
+	cs := params["charset"]
+	if cs == "" && !textualHttpMediaType(mt) {
+		return ""
+	}
+	switch {
+	case bytes.HasPrefix(body, httpBomUTF8):
+		return "utf-8"
+	case bytes.HasPrefix(body, httpBomUTF16LE):
+		return "utf-16le"
+	case bytes.HasPrefix(body, httpBomUTF16BE):
+		return "utf-16be"
+	}
+	if cs != "" {
+		return strings.ToLower(strings.Trim(cs, `"' `))
+	}
+	if mt == "text/html" || mt == "application/xhtml+xml" {
+		sniff := body
+		if len(sniff) > HTTP_CHARSET_SNIFF_SIZE {
+			sniff = sniff[:HTTP_CHARSET_SNIFF_SIZE]
+		}
+		if m := httpMetaCharset.FindSubmatch(sniff); m != nil {
+			return strings.ToLower(string(m[1]))
+		}
+	}
+	return ""
+}
+
+// text/*,json,xml,javascript等文本类型
+func textualHttpMediaType(mt string) bool {
+	switch {
+	case strings.HasPrefix(mt, "text/"),
+		strings.HasSuffix(mt, "+json"),
+		strings.HasSuffix(mt, "+xml"):
+		return true
+	}
+	switch mt {
+	case "application/json", "application/xml", "application/javascript", "application/ecmascript",
+		"application/x-javascript", "application/x-ndjson", "application/x-www-form-urlencoded":
+		return true
+	}
+	return false
+}
+
+func httpEncodingOf(charset string) (encoding.Encoding, error) {
+	switch charset {
+	case "utf-16le":
+		return unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM), nil
+	case "utf-16be":
+		return unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM), nil
+	}
+	return htmlindex.Get(charset)
+}
+
+// 按声明的字符集转码为UTF-8,并去掉UTF-8 BOM. 未知字符集原样返回
+func decodeHttpCharset(header http.Header, content string) (string, error) {
+	body := []byte(content)
+	charset := httpCharsetOf(header.Get("Content-Type"), body)
+	switch charset {
+	case "":
+		return content, nil
+	case "utf-8", "utf8", "us-ascii":
+		return strings.TrimPrefix(content, string(httpBomUTF8)), nil
+	}
+	enc, err := httpEncodingOf(charset)
+	if err != nil {
+		return content, nil
+	}
+	ret, _, err := transform.Bytes(enc.NewDecoder(), body)
+	if err != nil {
+		return content, err
+	}
+	return string(ret), nil
+}
+
+// 将UTF-8的请求body编码为指定字符集. 编码到内存中,使请求保留Content-Length且可在重定向时重发
+func encodeHttpCharset(charset string, body io.Reader) (io.Reader, error) {
+	enc, err := httpEncodingOf(strings.ToLower(charset))
+	if err != nil {
+		return nil, err
+	}
+	ret, err := ioutil.ReadAll(transform.NewReader(body, enc.NewEncoder()))
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(ret), nil
+}
+
+// 为Content-Type设置charset参数
+func withHttpCharset(contentType string, charset string) string {
+	mt, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+	params["charset"] = charset
+	return mime.FormatMediaType(mt, params)
+}
+
+// 是否按响应声明的字符集自动转码为UTF-8,默认为配置disableCharsetDecode取反
+func WithHttpDecodeCharset(decode bool) HttpOption {
+	return func(o *httpOptions) {
+		o.decodeCharset = decode
+	}
+}
+
+// 将请求body由UTF-8编码为指定字符集(如gbk,gb18030,big5),并在Content-Type中声明
+func WithHttpRequestCharset(charset string) HttpOption {
+	return func(o *httpOptions) {
+		o.requestCharset = charset
+	}
+}
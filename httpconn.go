@@ -0,0 +1,240 @@
+package kit
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 扣除拨号耗时后超过该值才视为等待连接
+const HTTP_CONN_WAIT_THRESHOLD = time.Millisecond
+
+// 单个host(host:port)的连接统计
+type HttpHostStats struct {
+	Host         string        `json:"host"`
+	Open         int64         `json:"open"`         // 当前打开的连接数
+	Idle         int64         `json:"idle"`         // 空闲连接数,即Open-InUse
+	InUse        int64         `json:"inUse"`        // 正在使用连接的请求数,HTTP/2多路复用时可能大于Open
+	Dials        int64         `json:"dials"`        // 累计拨号次数
+	DialFailures int64         `json:"dialFailures"` // 累计拨号失败次数
+	Waits        int64         `json:"waits"`        // 累计等待连接次数(如受MaxConnsPerHost限制)
+	WaitTime     time.Duration `json:"waitTime"`     // 累计等待连接时长,不含本请求的拨号耗时
+}
+
+// 字段全部用atomic操作,放在结构体开头保证32位平台的对齐
+type httpHostCounter struct {
+	open         int64
+	inUse        int64
+	dials        int64
+	dialFailures int64
+	waits        int64
+	waitTime     int64
+}
+
+// 全局唯一,重载后旧Transport的连接关闭时仍能正确扣减
+var httpConnCounters sync.Map // host => *httpHostCounter
+
+func httpHostCounterOf(host string) *httpHostCounter {
+	if v, ok := httpConnCounters.Load(host); ok {
+		return v.(*httpHostCounter)
+	}
+	v, _ := httpConnCounters.LoadOrStore(host, new(httpHostCounter))
+	return v.(*httpHostCounter)
+}
+
+// 返回各host的连接统计,按host排序. 需要配置trackConnections才有数据
+func HttpConnStats() []*HttpHostStats {
+	var rets []*HttpHostStats
+	httpConnCounters.Range(func(k, v interface{}) bool {
+		c := v.(*httpHostCounter)
+		s := &HttpHostStats{
+			Host:         k.(string),
+			Open:         atomic.LoadInt64(&c.open),
+			InUse:        atomic.LoadInt64(&c.inUse),
+			Dials:        atomic.LoadInt64(&c.dials),
+			DialFailures: atomic.LoadInt64(&c.dialFailures),
+			Waits:        atomic.LoadInt64(&c.waits),
+			WaitTime:     time.Duration(atomic.LoadInt64(&c.waitTime)),
+		}
+		if s.Idle = s.Open - s.InUse; s.Idle < 0 {
+			s.Idle = 0
+		}
+		rets = append(rets, s)
+		return true
+	})
+	sort.Slice(rets, func(i, j int) bool {
+		return rets[i].Host < rets[j].Host
+	})
+	return rets
+}
+
+// 以json输出HttpConnStats(),用于挂载到调试路由
+func HttpConnStatsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(HttpConnStats())
+	})
+}
+
+type httpDialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// context中保存本请求GetConn时的计数器,使拨号与占用连接按同一地址统计
+type httpConnCounterKey struct{}
+
+func httpDialCounterOf(ctx context.Context, addr string) *httpHostCounter {
+	if f, ok := ctx.Value(httpConnCounterKey{}).(func() *httpHostCounter); ok {
+		if c := f(); c != nil {
+			return c
+		}
+	}
+	return httpHostCounterOf(addr)
+}
+
+func trackHttpDial(dial httpDialFunc) httpDialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c := httpDialCounterOf(ctx, addr)
+		atomic.AddInt64(&c.dials, 1)
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			atomic.AddInt64(&c.dialFailures, 1)
+			return nil, err
+		}
+		atomic.AddInt64(&c.open, 1)
+		return &httpTrackedConn{Conn: conn, counter: c}, nil
+	}
+}
+
+type httpTrackedConn struct {
+	net.Conn
+	counter *httpHostCounter
+	once    sync.Once
+}
+
+func (c *httpTrackedConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt64(&c.counter.open, -1)
+	})
+	return c.Conn.Close()
+}
+
+// 统计请求占用连接及等待连接的时长
+type httpTrackedTransport struct {
+	http.RoundTripper
+}
+
+func (t httpTrackedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var (
+		mutex   sync.Mutex
+		counter *httpHostCounter
+		getConn time.Time
+		dialing time.Time
+		dialed  time.Duration
+		got     bool
+	)
+	trace := &httptrace.ClientTrace{
+		GetConn: func(hostPort string) {
+			mutex.Lock()
+			counter = httpHostCounterOf(hostPort)
+			getConn = time.Now()
+			mutex.Unlock()
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			mutex.Lock()
+			dialing = time.Now()
+			mutex.Unlock()
+		},
+		TLSHandshakeDone: func(tlsState tls.ConnectionState, err error) {
+			mutex.Lock()
+			if !dialing.IsZero() {
+				dialed = time.Since(dialing)
+			}
+			mutex.Unlock()
+		},
+		ConnectStart: func(network, addr string) {
+			mutex.Lock()
+			if dialing.IsZero() {
+				dialing = time.Now()
+			}
+			mutex.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mutex.Lock()
+			if !dialing.IsZero() {
+				dialed = time.Since(dialing)
+			}
+			mutex.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			mutex.Lock()
+			if counter != nil {
+				got = true
+				atomic.AddInt64(&counter.inUse, 1)
+				if !info.Reused {
+					if wait := time.Since(getConn) - dialed; wait > HTTP_CONN_WAIT_THRESHOLD {
+						atomic.AddInt64(&counter.waits, 1)
+						atomic.AddInt64(&counter.waitTime, int64(wait))
+					}
+				}
+			}
+			mutex.Unlock()
+		},
+	}
+	ctx := httptrace.WithClientTrace(req.Context(), trace)
+	ctx = context.WithValue(ctx, httpConnCounterKey{}, func() *httpHostCounter {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return counter
+	})
+	req = req.WithContext(ctx)
+	rsp, err := t.RoundTripper.RoundTrip(req)
+
+	mutex.Lock()
+	inUse := counter
+	if !got {
+		inUse = nil
+	}
+	mutex.Unlock()
+	if inUse == nil {
+		return rsp, err
+	}
+	// 101协议升级后连接由调用方接管,且ReverseProxy要求Body实现io.Writer,不能包装
+	if err != nil || rsp.StatusCode == http.StatusSwitchingProtocols {
+		atomic.AddInt64(&inUse.inUse, -1)
+		return rsp, err
+	}
+	rsp.Body = &httpTrackedBody{ReadCloser: rsp.Body, counter: inUse}
+	return rsp, nil
+}
+
+// body读完或关闭后视为连接已归还
+type httpTrackedBody struct {
+	io.ReadCloser
+	counter *httpHostCounter
+	once    sync.Once
+}
+
+func (b *httpTrackedBody) release() {
+	b.once.Do(func() {
+		atomic.AddInt64(&b.counter.inUse, -1)
+	})
+}
+
+func (b *httpTrackedBody) Read(p []byte) (n int, err error) {
+	if n, err = b.ReadCloser.Read(p); err != nil {
+		b.release()
+	}
+	return
+}
+
+func (b *httpTrackedBody) Close() error {
+	b.release()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,103 @@
+package kit
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+/*
+响应包装格式,例如{"code":0,"msg":"","data":{...}}:
+code不在OkCodes中时返回*HttpProblem,否则只将data解析到目标对象
+*/
+type HttpEnvelope struct {
+	CodeField string   `json:"codeField" yaml:"codeField"` // 默认code
+	MsgField  string   `json:"msgField" yaml:"msgField"`   // 默认msg
+	DataField string   `json:"dataField" yaml:"dataField"` // 默认data
+	OkCodes   []string `json:"okCodes" yaml:"okCodes"`     // 默认["0"]
+}
+
+// 返回填充默认值后的副本
+func (e *HttpEnvelope) fill() *HttpEnvelope {
+	if e == nil {
+		e = new(HttpEnvelope)
+	} else {
+		c := *e
+		e = &c
+	}
+	if e.CodeField == "" {
+		e.CodeField = "code"
+	}
+	if e.MsgField == "" {
+		e.MsgField = "msg"
+	}
+	if e.DataField == "" {
+		e.DataField = "data"
+	}
+	if len(e.OkCodes) == 0 {
+		e.OkCodes = []string{"0"}
+	}
+	return e
+}
+
+// 同HttpJson,但按配置envelope解包响应
+func HttpJsonData(method string, url string, header map[string]string, reqobj interface{}, rspobj interface{}) (status int, err error) {
+	return HttpJsonEnvelope(GetHttpConfig().Envelope, method, url, header, reqobj, rspobj)
+}
+
+// 同HttpJson,但按指定的envelope解包响应,env为nil时使用默认格式
+func HttpJsonEnvelope(env *HttpEnvelope, method string, url string, header map[string]string, reqobj interface{}, rspobj interface{}) (status int, err error) {
+	return HttpDoJson(method, url, reqobj, rspobj, WithHttpHeaderMap(header), WithHttpEnvelope(env))
+}
+
+/*
+非2xx时仍尝试解包,以便获取业务错误码;
+解包成功但code正常时返回nil,由调用方按状态码处理
+*/
+func unwrapHttpEnvelope(env *HttpEnvelope, status int, content string, rspobj interface{}) error {
+	env = env.fill()
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(content), &fields); err != nil {
+		if status < 200 || status > 299 {
+			return nil
+		}
+		return err
+	}
+	raw, ok := fields[env.CodeField]
+	if !ok {
+		if status < 200 || status > 299 {
+			return nil
+		}
+		return fmt.Errorf("missing envelope field %q: %s", env.CodeField, content)
+	}
+	code := httpEnvelopeString(raw)
+	for _, c := range env.OkCodes {
+		if c == code {
+			if status < 200 || status > 299 {
+				return nil
+			}
+			if data, ok := fields[env.DataField]; ok && rspobj != nil && string(data) != "null" {
+				return json.Unmarshal(data, rspobj)
+			}
+			return nil
+		}
+	}
+	return &HttpProblem{
+		Status:  status,
+		Code:    code,
+		Message: httpEnvelopeString(fields[env.MsgField]),
+		Body:    content,
+	}
+}
+
+func httpEnvelopeString(raw json.RawMessage) string {
+	if len(raw) == 0 || string(raw) == "null" {
+		return ""
+	}
+	if raw[0] == '"' {
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil {
+			return s
+		}
+	}
+	return string(raw)
+}
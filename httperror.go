@@ -0,0 +1,155 @@
+package kit
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+const (
+	HttpErrorDecoder_Problem = "problem" // RFC 7807 application/problem+json
+	HttpErrorDecoder_CodeMsg = "codemsg" // {"code":xxx,"msg":"xxx"}或{"code":xxx,"message":"xxx"}
+)
+
+/*
+结构化的非2xx响应,由HttpErrorDecoder从body解析而来.
+Type/Title/Detail/Instance对应RFC 7807,Code/Message对应业务错误码格式.
+*/
+type HttpProblem struct {
+	Status     int                    `json:"status"`
+	Type       string                 `json:"type,omitempty"`
+	Title      string                 `json:"title,omitempty"`
+	Detail     string                 `json:"detail,omitempty"`
+	Instance   string                 `json:"instance,omitempty"`
+	Code       string                 `json:"code,omitempty"`
+	Message    string                 `json:"msg,omitempty"`
+	Extensions map[string]interface{} `json:"-"` // 其他非标准字段
+	Body       string                 `json:"-"` // 原始body
+}
+
+func (p *HttpProblem) Error() string {
+	switch {
+	case p.Code != "" && p.Message != "":
+		return fmt.Sprintf("http %d: [%s] %s", p.Status, p.Code, p.Message)
+	case p.Code != "":
+		return fmt.Sprintf("http %d: [%s]", p.Status, p.Code)
+	case p.Title != "" && p.Detail != "":
+		return fmt.Sprintf("http %d: %s: %s", p.Status, p.Title, p.Detail)
+	case p.Title != "":
+		return fmt.Sprintf("http %d: %s", p.Status, p.Title)
+	case p.Detail != "":
+		return fmt.Sprintf("http %d: %s", p.Status, p.Detail)
+	}
+	return fmt.Sprintf("http %d: %s", p.Status, p.Body)
+}
+
+// 尝试将非2xx的响应解析为HttpProblem,格式不匹配返回nil
+type HttpErrorDecoder func(status int, header http.Header, body []byte) *HttpProblem
+
+var (
+	httpErrorDecoderMutex sync.RWMutex
+	httpErrorDecoders     = map[string]HttpErrorDecoder{
+		HttpErrorDecoder_Problem: decodeHttpProblem,
+		HttpErrorDecoder_CodeMsg: decodeHttpCodeMsg,
+	}
+)
+
+// 注册自定义的错误格式,之后可以在配置errorDecoders中按名称引用
+func RegisterHttpErrorDecoder(name string, decoder HttpErrorDecoder) {
+	httpErrorDecoderMutex.Lock()
+	httpErrorDecoders[name] = decoder
+	httpErrorDecoderMutex.Unlock()
+}
+
+func getHttpErrorDecoder(name string) HttpErrorDecoder {
+	httpErrorDecoderMutex.RLock()
+	defer httpErrorDecoderMutex.RUnlock()
+	return httpErrorDecoders[name]
+}
+
+// 按names(默认为配置errorDecoders)的顺序解析,都不匹配时保持旧行为返回HttpError
+func decodeHttpErrorWith(names []string, status int, header http.Header, content string) error {
+	if len(names) > 0 && content != "" {
+		body := []byte(content)
+		for _, name := range names {
+			if decoder := getHttpErrorDecoder(name); decoder != nil {
+				if p := decoder(status, header, body); p != nil {
+					if p.Status == 0 {
+						p.Status = status
+					}
+					p.Body = content
+					return p
+				}
+			}
+		}
+	}
+	return HttpError(content)
+}
+
+func decodeHttpProblem(status int, header http.Header, body []byte) *HttpProblem {
+	if mt, _, _ := mime.ParseMediaType(header.Get("Content-Type")); mt != "application/problem+json" {
+		return nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil
+	}
+	p := &HttpProblem{Status: status}
+	for k, v := range fields {
+		switch k {
+		case "status":
+			if n, ok := v.(float64); ok {
+				p.Status = int(n)
+			}
+		case "type":
+			p.Type = httpProblemString(v)
+		case "title":
+			p.Title = httpProblemString(v)
+		case "detail":
+			p.Detail = httpProblemString(v)
+		case "instance":
+			p.Instance = httpProblemString(v)
+		default:
+			if p.Extensions == nil {
+				p.Extensions = make(map[string]interface{})
+			}
+			p.Extensions[k] = v
+		}
+	}
+	return p
+}
+
+func decodeHttpCodeMsg(status int, header http.Header, body []byte) *HttpProblem {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil
+	}
+	code, ok := fields["code"]
+	if !ok || code == nil {
+		return nil
+	}
+	p := &HttpProblem{Status: status, Code: httpProblemString(code)}
+	if msg, ok := fields["msg"]; ok {
+		p.Message = httpProblemString(msg)
+	} else if msg, ok := fields["message"]; ok {
+		p.Message = httpProblemString(msg)
+	}
+	return p
+}
+
+func httpProblemString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return Json(v)
+}
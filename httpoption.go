@@ -0,0 +1,202 @@
+package kit
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// HttpDo/HttpDoJson的请求选项
+type HttpOption func(o *httpOptions)
+
+type httpOptions struct {
+	ctx            context.Context
+	header         http.Header
+	host           string
+	username       string
+	password       string
+	basicAuth      bool
+	query          url.Values
+	timeout        time.Duration
+	defContentType string // 默认Content-Type,可被请求头覆盖
+	contentType    string
+	contentTypeSet bool
+	timing         *HttpTiming
+	errorDecoders  []string
+	envelope       *HttpEnvelope
+	envelopeSet    bool
+	decodeCharset  bool
+	requestCharset string
+}
+
+func newHttpOptions(opts ...HttpOption) *httpOptions {
+	c := GetHttpConfig()
+	o := &httpOptions{
+		ctx:           context.Background(),
+		header:        make(http.Header),
+		errorDecoders: c.ErrorDecoders,
+		decodeCharset: !c.DisableCharsetDecode,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+func (o *httpOptions) setHeaderMap(header map[string]string) {
+	for k, v := range header {
+		o.header.Set(k, v)
+	}
+}
+
+// 优先级: WithHttpContentType > 请求头中的Content-Type > 默认Content-Type
+func (o *httpOptions) apply(req *http.Request) {
+	if o.defContentType != "" {
+		req.Header.Set("Content-Type", o.defContentType)
+	}
+	for k, vs := range o.header {
+		if k == "Content-Type" {
+			req.Header.Del(k)
+		}
+		req.Header[k] = append(req.Header[k], vs...)
+	}
+	if o.contentTypeSet {
+		if o.contentType == "" {
+			req.Header.Del("Content-Type")
+		} else {
+			req.Header.Set("Content-Type", o.contentType)
+		}
+	}
+	if ct := req.Header.Get("Content-Type"); ct != "" && o.requestCharset != "" {
+		req.Header.Set("Content-Type", withHttpCharset(ct, o.requestCharset))
+	}
+	if o.host != "" {
+		req.Host = o.host
+	}
+	if o.basicAuth {
+		req.SetBasicAuth(o.username, o.password)
+	}
+}
+
+func WithHttpContext(ctx context.Context) HttpOption {
+	return func(o *httpOptions) {
+		o.ctx = ctx
+	}
+}
+
+// 追加请求头,可重复调用以设置多值头
+func WithHttpHeader(key string, value string) HttpOption {
+	return func(o *httpOptions) {
+		o.header.Add(key, value)
+	}
+}
+
+// 追加请求头的所有值
+func WithHttpHeaders(header http.Header) HttpOption {
+	return func(o *httpOptions) {
+		for k, vs := range header {
+			for _, v := range vs {
+				o.header.Add(k, v)
+			}
+		}
+	}
+}
+
+// 按map设置请求头,同名头会被覆盖,与旧接口的header参数语义一致
+func WithHttpHeaderMap(header map[string]string) HttpOption {
+	return func(o *httpOptions) {
+		o.setHeaderMap(header)
+	}
+}
+
+// 覆盖请求的Host,用于按虚拟主机访问IP地址等场景
+func WithHttpHost(host string) HttpOption {
+	return func(o *httpOptions) {
+		o.host = host
+	}
+}
+
+func WithHttpBasicAuth(username string, password string) HttpOption {
+	return func(o *httpOptions) {
+		o.username, o.password, o.basicAuth = username, password, true
+	}
+}
+
+// 追加查询参数,可重复调用以设置多值参数
+func WithHttpQuery(key string, value string) HttpOption {
+	return func(o *httpOptions) {
+		if o.query == nil {
+			o.query = make(url.Values)
+		}
+		o.query.Add(key, value)
+	}
+}
+
+func WithHttpQueryValues(values url.Values) HttpOption {
+	return func(o *httpOptions) {
+		if o.query == nil {
+			o.query = make(url.Values)
+		}
+		for k, vs := range values {
+			o.query[k] = append(o.query[k], vs...)
+		}
+	}
+}
+
+// 单次请求的超时,包括读取body. 与HttpConfig.RequestTimeout同时生效
+func WithHttpTimeout(timeout time.Duration) HttpOption {
+	return func(o *httpOptions) {
+		o.timeout = timeout
+	}
+}
+
+// 覆盖Content-Type,传空字符串表示不发送Content-Type
+func WithHttpContentType(contentType string) HttpOption {
+	return func(o *httpOptions) {
+		o.contentType, o.contentTypeSet = contentType, true
+	}
+}
+
+// 请求完成后将耗时分解写入timing
+func WithHttpTiming(timing *HttpTiming) HttpOption {
+	return func(o *httpOptions) {
+		o.timing = timing
+	}
+}
+
+// 覆盖配置中的errorDecoders,不传参数表示不解析错误body
+func WithHttpErrorDecoders(names ...string) HttpOption {
+	return func(o *httpOptions) {
+		o.errorDecoders = names
+	}
+}
+
+// HttpDoJson按envelope解包响应,env为nil时使用默认格式
+func WithHttpEnvelope(env *HttpEnvelope) HttpOption {
+	return func(o *httpOptions) {
+		o.envelope, o.envelopeSet = env, true
+	}
+}
+
+// 发送请求并读取全部body,默认不设置Content-Type
+func HttpDo(method string, url string, body io.Reader, opts ...HttpOption) (state int, content string, err error) {
+	state, _, content, err = httpRequest(method, url, body, newHttpOptions(opts...))
+	return
+}
+
+// reqobj序列化为json发送,2xx时将响应解析到rspobj,默认Content-Type为application/json
+func HttpDoJson(method string, url string, reqobj interface{}, rspobj interface{}, opts ...HttpOption) (status int, err error) {
+	o := newHttpOptions(opts...)
+	o.defContentType = "application/json"
+	return httpJson(method, url, reqobj, rspobj, o)
+}
+
+func joinQueryValues(rurl string, query url.Values) string {
+	if strings.IndexByte(rurl, '?') < 0 {
+		return rurl + "?" + query.Encode()
+	}
+	return rurl + "&" + query.Encode()
+}
@@ -0,0 +1,147 @@
+package kit
+
+import (
+	"fmt"
+	"github.com/obase/conf"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 旧运行时的请求全部结束后,等待Transport异步归还连接的时间,之后再关闭一次空闲连接
+const HTTP_RELOAD_SETTLE = time.Second
+
+/*
+退役旧运行时: 立即关闭空闲连接,并在经由它发出的请求全部结束后再关闭一次,
+回收进行中请求归还的连接,避免在IdleConnTimeout为0时永远不关闭
+*/
+func closeHttpRuntime(rt *httpRuntime) {
+	atomic.StoreInt32(&rt.retired, 1)
+	rt.closeIdleConnections()
+	if atomic.LoadInt64(&rt.active) == 0 {
+		time.AfterFunc(HTTP_RELOAD_SETTLE, rt.closeIdleConnections)
+	}
+}
+
+func (rt *httpRuntime) closeIdleConnections() {
+	rt.transport.CloseIdleConnections()
+	rt.proxyTransport.CloseIdleConnections()
+}
+
+func (rt *httpRuntime) release() {
+	if atomic.AddInt64(&rt.active, -1) == 0 && atomic.LoadInt32(&rt.retired) == 1 {
+		time.AfterFunc(HTTP_RELOAD_SETTLE, rt.closeIdleConnections)
+	}
+}
+
+// 统计经由运行时发出且body尚未读完或关闭的请求
+type httpRuntimeTransport struct {
+	http.RoundTripper
+	rt *httpRuntime
+}
+
+func (t httpRuntimeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&t.rt.active, 1)
+	rsp, err := t.RoundTripper.RoundTrip(req)
+	// 101协议升级后连接由调用方接管,不会归还连接池
+	if err != nil || rsp.StatusCode == http.StatusSwitchingProtocols {
+		t.rt.release()
+		return rsp, err
+	}
+	rsp.Body = &httpRuntimeBody{ReadCloser: rsp.Body, rt: t.rt}
+	return rsp, nil
+}
+
+type httpRuntimeBody struct {
+	io.ReadCloser
+	rt   *httpRuntime
+	once sync.Once
+}
+
+func (b *httpRuntimeBody) release() {
+	b.once.Do(b.rt.release)
+}
+
+func (b *httpRuntimeBody) Read(p []byte) (n int, err error) {
+	if n, err = b.ReadCloser.Read(p); err != nil {
+		b.release()
+	}
+	return
+}
+
+func (b *httpRuntimeBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// 读取conf中的http配置,同时返回原始值用于比较变化
+func loadHttpConfig() (c *HttpConfig, raw interface{}, err error) {
+	if cnf, ok := conf.Get(HTTP_CKEY); ok {
+		raw = cnf
+		if err = conf.Convert(cnf, &c); err == nil && c != nil {
+			_, c.DisableCompressionSet = conf.Elem(cnf, "disableCompression")
+			_, c.ForceAttemptHTTP2Set = conf.Elem(cnf, "forceAttemptHTTP2")
+		}
+	}
+	return
+}
+
+/*
+按conf中当前的http配置重新初始化GetHttpTransport()/GetHttpClient()/GetReverseProxy()返回的对象.
+与SetupHttp不同,配置非法时不会panic而是返回错误并保留原配置
+*/
+func ReloadHttp() error {
+	c, _, err := loadHttpConfig()
+	if err != nil {
+		return fmt.Errorf("reload http failed: %v", err)
+	}
+	return reloadHttp(c)
+}
+
+func reloadHttp(c *HttpConfig) (err error) {
+	defer func() {
+		if perr := recover(); perr != nil {
+			err = fmt.Errorf("reload http failed: %v", perr)
+		}
+	}()
+	SetupHttp(c)
+	return
+}
+
+/*
+定期检查conf中的http配置,发生变化时自动重载. 返回的stop用于停止检查.
+*/
+func WatchHttp(interval time.Duration) (stop func()) {
+	_, last, _ := loadHttpConfig()
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				c, raw, err := loadHttpConfig()
+				if reflect.DeepEqual(raw, last) {
+					continue
+				}
+				last = raw
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "watch http: %v\n", err)
+				} else if err = reloadHttp(c); err != nil {
+					fmt.Fprintf(os.Stderr, "watch http: %v\n", err)
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
@@ -0,0 +1,293 @@
+package kit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const HTTP_SSE_RETRY = 3 * time.Second // 默认重连间隔
+
+var ErrHttpStreamClosed = errors.New("http stream closed")
+
+// 流式响应不能受RequestTimeout限制,但仍使用当前HttpTransport
+var httpStreamClient = &http.Client{Transport: httpDynamicTransport{}}
+
+// Server-Sent Events中的一个事件
+type HttpEvent struct {
+	Id    string // 事件的id,没有时沿用之前的id(即当时的LastEventId)
+	Event string // 为空表示"message"
+	Data  string
+	Retry time.Duration
+}
+
+/*
+Server-Sent Events客户端:
+1. 断线或服务端关闭连接后按Retry间隔自动重连,并携带Last-Event-ID
+2. 服务端返回204,或返回非200/非text/event-stream时不再重连,Next()返回错误
+3. 非并发安全,Next()需在同一goroutine中调用,Close()可在任意goroutine中调用
+*/
+type HttpEventSource struct {
+	Url         string
+	Header      map[string]string
+	LastEventId string
+	Retry       time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	mutex  sync.Mutex
+	body   io.ReadCloser
+	reader *bufio.Reader
+}
+
+func NewHttpEventSource(url string, header map[string]string) *HttpEventSource {
+	s := &HttpEventSource{
+		Url:    url,
+		Header: header,
+		Retry:  HTTP_SSE_RETRY,
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s
+}
+
+func (s *HttpEventSource) connect() (err error) {
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodGet, s.Url, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	for k, v := range s.Header {
+		req.Header.Set(k, v)
+	}
+	if s.LastEventId != "" {
+		req.Header.Set("Last-Event-ID", s.LastEventId)
+	}
+	rsp, err := httpStreamClient.Do(req)
+	if err != nil {
+		return
+	}
+	if rsp.StatusCode != http.StatusOK {
+		content, _ := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if rsp.StatusCode == http.StatusNoContent {
+			return ErrHttpStreamClosed
+		}
+		return httpStreamFatal{HttpError(content)}
+	}
+	if mt, _, _ := mime.ParseMediaType(rsp.Header.Get("Content-Type")); mt != "text/event-stream" {
+		rsp.Body.Close()
+		return httpStreamFatal{HttpError("unexpected content type: " + rsp.Header.Get("Content-Type"))}
+	}
+	s.mutex.Lock()
+	s.body = rsp.Body
+	s.mutex.Unlock()
+	s.reader = bufio.NewReader(rsp.Body)
+	return
+}
+
+func (s *HttpEventSource) disconnect() {
+	s.closeBody()
+	s.reader = nil
+}
+
+// 不可重连的错误
+type httpStreamFatal struct {
+	error
+}
+
+// 阻塞直到收到下一个事件,连接断开时自动重连. 调用Close()后返回ErrHttpStreamClosed
+func (s *HttpEventSource) Next() (*HttpEvent, error) {
+	for {
+		if err := s.ctx.Err(); err != nil {
+			return nil, ErrHttpStreamClosed
+		}
+		if s.reader == nil {
+			if err := s.connect(); err != nil {
+				if fatal, ok := err.(httpStreamFatal); ok {
+					return nil, fatal.error
+				}
+				if err == ErrHttpStreamClosed {
+					s.Close()
+					return nil, err
+				}
+				if !s.wait() {
+					return nil, ErrHttpStreamClosed
+				}
+				continue
+			}
+		}
+		if evt, err := s.read(); err == nil {
+			return evt, nil
+		}
+		s.disconnect()
+		if !s.wait() {
+			return nil, ErrHttpStreamClosed
+		}
+	}
+}
+
+func (s *HttpEventSource) wait() bool {
+	timer := time.NewTimer(s.Retry)
+	defer timer.Stop()
+	select {
+	case <-s.ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (s *HttpEventSource) read() (*HttpEvent, error) {
+	var (
+		evt   = new(HttpEvent)
+		data  bytes.Buffer
+		has   bool
+		id    string
+		hasId bool
+	)
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			// 没有data的块也会更新LastEventId,空的id表示重置
+			if hasId {
+				s.LastEventId, hasId = id, false
+			}
+			if !has {
+				evt = new(HttpEvent)
+				continue
+			}
+			evt.Id = s.LastEventId
+			evt.Data = data.String()
+			return evt, nil
+		}
+		if line[0] == ':' {
+			continue // 注释
+		}
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "event":
+			evt.Event = value
+		case "data":
+			if has {
+				data.WriteByte('\n')
+			}
+			data.WriteString(value)
+			has = true
+		case "id":
+			if strings.IndexByte(value, 0) < 0 {
+				id, hasId = value, true
+			}
+		case "retry":
+			if ms, err := strconv.ParseInt(value, 10, 64); err == nil && ms >= 0 {
+				evt.Retry = time.Duration(ms) * time.Millisecond
+				s.Retry = evt.Retry
+			}
+		}
+	}
+}
+
+func (s *HttpEventSource) Close() error {
+	s.cancel()
+	s.closeBody()
+	return nil
+}
+
+// 仅关闭body以中断阻塞的读,reader由Next()所在goroutine清理
+func (s *HttpEventSource) closeBody() {
+	s.mutex.Lock()
+	if s.body != nil {
+		s.body.Close()
+		s.body = nil
+	}
+	s.mutex.Unlock()
+}
+
+/*
+NDJSON(newline-delimited json)响应迭代器,用法:
+
+	it, err := HttpNDJson(method, url, header, reqobj)
+	defer it.Close()
+	for it.Next(&v) {...}
+	err = it.Err()
+*/
+type HttpNDJsonIterator struct {
+	body    io.ReadCloser
+	decoder *json.Decoder
+	err     error
+}
+
+func HttpNDJson(method string, url string, header map[string]string, reqobj interface{}) (*HttpNDJsonIterator, error) {
+	return HttpNDJsonContext(context.Background(), method, url, header, reqobj)
+}
+
+func HttpNDJsonContext(ctx context.Context, method string, url string, header map[string]string, reqobj interface{}) (*HttpNDJsonIterator, error) {
+	var body io.Reader
+	if reqobj != nil {
+		data, err := json.Marshal(reqobj)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/x-ndjson")
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	rsp, err := httpStreamClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		content, _ := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		return nil, HttpError(content)
+	}
+	return &HttpNDJsonIterator{body: rsp.Body, decoder: json.NewDecoder(rsp.Body)}, nil
+}
+
+// 解析下一行到v,结束或出错返回false
+func (it *HttpNDJsonIterator) Next(v interface{}) bool {
+	if it.err != nil {
+		return false
+	}
+	if err := it.decoder.Decode(v); err != nil {
+		it.err = err
+		return false
+	}
+	return true
+}
+
+// 返回迭代过程中的错误,正常结束返回nil
+func (it *HttpNDJsonIterator) Err() error {
+	if it.err == io.EOF {
+		return nil
+	}
+	return it.err
+}
+
+func (it *HttpNDJsonIterator) Close() error {
+	return it.body.Close()
+}
@@ -0,0 +1,91 @@
+package kit
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHttpEventSource(t *testing.T) {
+	var lastIds []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastIds = append(lastIds, r.Header.Get("Last-Event-ID"))
+		w.Header().Set("Content-Type", "text/event-stream")
+		if len(lastIds) == 1 {
+			fmt.Fprint(w, ": comment\nretry: 10\n\nevent: add\nid: 1\ndata: a\ndata: b\n\n")
+			return // 断开连接,触发重连
+		}
+		if len(lastIds) == 2 {
+			// 没有data的id同样生效,之后的事件沿用;空的id重置
+			fmt.Fprint(w, "id: 2\r\ndata:c\r\n\r\nid: 3\n\ndata: d\n\nid\n\n")
+			return
+		}
+		fmt.Fprint(w, "data: e\n\n")
+	}))
+	defer srv.Close()
+
+	es := NewHttpEventSource(srv.URL, nil)
+	defer es.Close()
+
+	evt, err := es.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evt.Event != "add" || evt.Id != "1" || evt.Data != "a\nb" {
+		t.Fatalf("unexpected event: %+v", evt)
+	}
+	if es.Retry != 10*time.Millisecond {
+		t.Fatalf("unexpected retry: %v", es.Retry)
+	}
+	if evt, err = es.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if evt.Id != "2" || evt.Data != "c" {
+		t.Fatalf("unexpected event: %+v", evt)
+	}
+	if lastIds[1] != "1" {
+		t.Fatalf("expected Last-Event-ID on reconnect, got %q", lastIds[1])
+	}
+	if evt, err = es.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if evt.Id != "3" || evt.Data != "d" {
+		t.Fatalf("unexpected event: %+v", evt)
+	}
+	if evt, err = es.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if evt.Id != "" || evt.Data != "e" || lastIds[2] != "" {
+		t.Fatalf("unexpected event after id reset: %+v, Last-Event-ID %q", evt, lastIds[2])
+	}
+}
+
+func TestHttpNDJson(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "{\"n\":%d}\n", i)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer srv.Close()
+
+	it, err := HttpNDJson(http.MethodGet, srv.URL, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+
+	var v struct{ N int }
+	var count int
+	for it.Next(&v) {
+		if v.N != count {
+			t.Fatalf("unexpected value: %d", v.N)
+		}
+		count++
+	}
+	if it.Err() != nil || count != 3 {
+		t.Fatalf("count=%d err=%v", count, it.Err())
+	}
+}
@@ -0,0 +1,144 @@
+package kit
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 单次请求的耗时分解
+type HttpTiming struct {
+	DNS          time.Duration `json:"dns"`          // DNS解析耗时
+	Connect      time.Duration `json:"connect"`      // TCP建连耗时
+	TLSHandshake time.Duration `json:"tlsHandshake"` // TLS握手耗时
+	FirstByte    time.Duration `json:"firstByte"`    // 请求写完到收到首字节,即服务端处理耗时
+	Transfer     time.Duration `json:"transfer"`     // 首字节到body读取完毕
+	Total        time.Duration `json:"total"`        // 总耗时
+	Reused       bool          `json:"reused"`       // 是否复用已有连接
+	WasIdle      bool          `json:"wasIdle"`      // 复用的连接是否来自空闲池
+	IdleTime     time.Duration `json:"idleTime"`     // 复用连接此前的空闲时长
+	RemoteAddr   string        `json:"remoteAddr"`   // 实际连接的服务端地址
+}
+
+// 所有Http辅助方法完成后回调,state为0表示请求失败
+type HttpTimingHook func(req *http.Request, state int, timing *HttpTiming)
+
+type httpTimingHookHolder struct {
+	fn HttpTimingHook
+}
+
+var httpTimingHook atomic.Value // httpTimingHookHolder
+
+// 设置全局耗时回调,传nil表示取消
+func SetHttpTimingHook(fn HttpTimingHook) {
+	httpTimingHook.Store(httpTimingHookHolder{fn: fn})
+}
+
+func getHttpTimingHook() HttpTimingHook {
+	h, _ := httpTimingHook.Load().(httpTimingHookHolder)
+	return h.fn
+}
+
+// httptrace回调可能来自不同goroutine(如多地址并行拨号),需要加锁
+type httpTimer struct {
+	sync.Mutex
+	timing    HttpTiming
+	start     time.Time
+	dnsStart  time.Time
+	connStart time.Time
+	tlsStart  time.Time
+	wrote     time.Time
+	firstByte time.Time
+}
+
+func newHttpTimer() *httpTimer {
+	return &httpTimer{start: time.Now()}
+}
+
+func (t *httpTimer) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.Lock()
+			t.dnsStart = time.Now()
+			t.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.Lock()
+			t.timing.DNS = time.Since(t.dnsStart)
+			t.Unlock()
+		},
+		ConnectStart: func(network, addr string) {
+			t.Lock()
+			if t.connStart.IsZero() {
+				t.connStart = time.Now()
+			}
+			t.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.Lock()
+			if err == nil {
+				t.timing.Connect = time.Since(t.connStart)
+			}
+			t.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			t.Lock()
+			t.tlsStart = time.Now()
+			t.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.Lock()
+			t.timing.TLSHandshake = time.Since(t.tlsStart)
+			t.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.Lock()
+			t.timing.Reused = info.Reused
+			t.timing.WasIdle = info.WasIdle
+			t.timing.IdleTime = info.IdleTime
+			if info.Conn != nil {
+				t.timing.RemoteAddr = info.Conn.RemoteAddr().String()
+			}
+			t.Unlock()
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.Lock()
+			t.wrote = time.Now()
+			t.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			t.Lock()
+			t.firstByte = time.Now()
+			if !t.wrote.IsZero() {
+				t.timing.FirstByte = t.firstByte.Sub(t.wrote)
+			}
+			t.Unlock()
+		},
+	}
+}
+
+// body读取完毕(或请求失败)后调用
+func (t *httpTimer) done() (ret HttpTiming) {
+	now := time.Now()
+	t.Lock()
+	if !t.firstByte.IsZero() {
+		t.timing.Transfer = now.Sub(t.firstByte)
+	}
+	t.timing.Total = now.Sub(t.start)
+	ret = t.timing
+	t.Unlock()
+	return
+}
+
+// 同HttpRequest,并返回耗时分解
+func HttpRequestTiming(method string, url string, header map[string]string, body io.Reader) (state int, content string, timing *HttpTiming, err error) {
+	timing = new(HttpTiming)
+	o := newHttpOptions(WithHttpHeaderMap(header), WithHttpTiming(timing))
+	o.defContentType = "application/json"
+	state, _, content, err = httpRequest(method, url, body, o)
+	return
+}
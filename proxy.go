@@ -0,0 +1,312 @@
+package kit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var ErrProxyReverseHeader = errors.New("proxy error: reserved header " + REVERSE_SCHEME + "/" + REVERSE_HOST + "/" + REVERSE_PATH + " not allowed")
+
+type proxyTargetKey struct{}
+
+// 返回携带代理目标的请求副本,供ReverseProxy的Director读取
+func WithProxyTarget(req *http.Request, target *url.URL) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), proxyTargetKey{}, target))
+}
+
+// 返回WithProxyTarget设置的代理目标,没有则返回nil
+func ProxyTarget(req *http.Request) *url.URL {
+	target, _ := req.Context().Value(proxyTargetKey{}).(*url.URL)
+	return target
+}
+
+type proxyRejectKey struct{}
+
+// Director无法直接返回错误,将拒绝的原因放入出站请求的context,由proxyRejectTransport交给ErrorHandler
+func rejectProxyRequest(req *http.Request, err error) {
+	*req = *req.WithContext(context.WithValue(req.Context(), proxyRejectKey{}, err))
+}
+
+type proxyRejectTransport struct {
+	http.RoundTripper
+}
+
+func (t proxyRejectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err, ok := req.Context().Value(proxyRejectKey{}).(error); ok {
+		return nil, err
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
+
+func hasReverseHeader(header http.Header) bool {
+	for _, k := range []string{REVERSE_SCHEME, REVERSE_HOST, REVERSE_PATH} {
+		if _, ok := header[http.CanonicalHeaderKey(k)]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	ProxyPath_Replace = "replace" // 用目标路径替换入站路径(默认,兼容旧版本)
+	ProxyPath_Join    = "join"    // 目标路径+入站路径,同httputil.NewSingleHostReverseProxy
+	ProxyPath_Strip   = "strip"   // 去掉入站路径的前缀后再与目标路径拼接
+	ProxyPath_Regex   = "regex"   // 按正则改写入站路径后再与目标路径拼接
+)
+
+const (
+	ProxyHost_Inbound  = "inbound"  // 保留入站请求的Host(默认,兼容旧版本)
+	ProxyHost_Upstream = "upstream" // 使用上游地址的Host
+)
+
+// HttpProxyHandler等代理处理器的选项
+type ProxyOption func(o *proxyOptions)
+
+type proxyOptions struct {
+	pathMode        string
+	stripPrefix     string
+	pathRegex       *regexp.Regexp
+	pathRepl        string
+	hostPolicy      string
+	requestHeaders  *ProxyHeaderRules
+	responseHeaders *ProxyHeaderRules
+	bodyRewriters   []ProxyBodyRewriter
+	mirror          *ProxyMirror
+}
+
+type proxyOptionsKey struct{}
+
+// 返回携带代理选项的请求副本,覆盖处理器自身的选项. 用于多个路由共享同一个ProxyPool
+func withProxyOptions(req *http.Request, o *proxyOptions) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), proxyOptionsKey{}, o))
+}
+
+func proxyOptionsOf(req *http.Request, def *proxyOptions) *proxyOptions {
+	if o, ok := req.Context().Value(proxyOptionsKey{}).(*proxyOptions); ok {
+		return o
+	}
+	return def
+}
+
+/*
+请求头或响应头的改写规则,依次执行Remove,Set,Add
+*/
+type ProxyHeaderRules struct {
+	Set    map[string]string `json:"set" yaml:"set"`
+	Add    map[string]string `json:"add" yaml:"add"`
+	Remove []string          `json:"remove" yaml:"remove"`
+}
+
+func (h *ProxyHeaderRules) apply(header http.Header) {
+	if h == nil {
+		return
+	}
+	for _, k := range h.Remove {
+		header.Del(k)
+	}
+	for k, v := range h.Set {
+		header.Set(k, v)
+	}
+	for k, v := range h.Add {
+		header.Add(k, v)
+	}
+}
+
+func newProxyOptions(opts ...ProxyOption) *proxyOptions {
+	o := &proxyOptions{
+		pathMode:   ProxyPath_Replace,
+		hostPolicy: ProxyHost_Inbound,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// 用目标路径替换入站路径,即旧版本行为
+func WithProxyPathReplace() ProxyOption {
+	return func(o *proxyOptions) {
+		o.pathMode = ProxyPath_Replace
+	}
+}
+
+// 将入站路径拼接到目标路径之后
+func WithProxyPathJoin() ProxyOption {
+	return func(o *proxyOptions) {
+		o.pathMode = ProxyPath_Join
+	}
+}
+
+// 去掉入站路径的prefix后拼接到目标路径之后,如prefix为/api时/api/users转发到<target>/users.
+// 只按完整的路径段匹配,/apiary不会被改写
+func WithProxyStripPrefix(prefix string) ProxyOption {
+	return func(o *proxyOptions) {
+		o.pathMode = ProxyPath_Strip
+		o.stripPrefix = prefix
+	}
+}
+
+// 按regexp.ReplaceAllString改写入站路径后拼接到目标路径之后,pattern非法时panic
+func WithProxyPathRegex(pattern string, repl string) ProxyOption {
+	re := regexp.MustCompile(pattern)
+	return func(o *proxyOptions) {
+		o.pathMode = ProxyPath_Regex
+		o.pathRegex = re
+		o.pathRepl = repl
+	}
+}
+
+/*
+出站请求的Host:
+1. ProxyHost_Inbound: 保留入站Host
+2. ProxyHost_Upstream: 使用上游地址的Host,适用于按虚拟主机区分的上游
+3. 其他值: 作为固定的Host
+*/
+func WithProxyHost(policy string) ProxyOption {
+	return func(o *proxyOptions) {
+		o.hostPolicy = policy
+	}
+}
+
+// 改写转发给上游的请求头,在转发头与内部保留头处理之后执行
+func WithProxyRequestHeaders(rules ProxyHeaderRules) ProxyOption {
+	return func(o *proxyOptions) {
+		o.requestHeaders = &rules
+	}
+}
+
+// 改写返回给客户端的响应头
+func WithProxyResponseHeaders(rules ProxyHeaderRules) ProxyOption {
+	return func(o *proxyOptions) {
+		o.responseHeaders = &rules
+	}
+}
+
+// 将出站请求指向target,并删除内部保留的请求头. 入站请求携带保留头时拒绝转发,同HttpProxy
+func (o *proxyOptions) direct(req *http.Request, target *url.URL) {
+	if hasReverseHeader(req.Header) {
+		rejectProxyRequest(req, ErrProxyReverseHeader)
+		return
+	}
+	currentHttp().forwarding.apply(req)
+	var inbound url.URL
+	host := req.Host
+	if o.mirror != nil {
+		inbound = *req.URL
+	}
+	if target != nil {
+		o.retarget(req, target)
+	}
+	o.requestHeaders.apply(req.Header)
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// explicitly disable User-Agent so it's not set to default value
+		req.Header.Set("User-Agent", "")
+	}
+	if o.mirror != nil {
+		o.mirror.capture(o, req, &inbound, host)
+	}
+}
+
+func (o *proxyOptions) modifyResponse(rsp *http.Response) error {
+	o.responseHeaders.apply(rsp.Header)
+	if len(o.bodyRewriters) > 0 {
+		return rewriteProxyBody(rsp, o.bodyRewriters)
+	}
+	return nil
+}
+
+// 按入站的URL与Host改写出站的URL与Host
+func (o *proxyOptions) retarget(req *http.Request, target *url.URL) {
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	o.rewritePath(req.URL, target)
+	switch o.hostPolicy {
+	case ProxyHost_Inbound:
+	case ProxyHost_Upstream:
+		req.Host = target.Host
+	default:
+		req.Host = o.hostPolicy
+	}
+	if target.RawQuery == "" || req.URL.RawQuery == "" {
+		req.URL.RawQuery = target.RawQuery + req.URL.RawQuery
+	} else {
+		req.URL.RawQuery = target.RawQuery + "&" + req.URL.RawQuery
+	}
+}
+
+func (o *proxyOptions) rewritePath(u *url.URL, target *url.URL) {
+	switch o.pathMode {
+	case ProxyPath_Join:
+	case ProxyPath_Strip:
+		if hasProxyPathPrefix(u.Path, o.stripPrefix) {
+			u.Path = u.Path[len(o.stripPrefix):]
+			if strings.HasPrefix(u.RawPath, o.stripPrefix) {
+				u.RawPath = u.RawPath[len(o.stripPrefix):]
+			} else {
+				u.RawPath = ""
+			}
+		}
+	case ProxyPath_Regex:
+		if u.RawPath == "" {
+			u.Path = o.pathRegex.ReplaceAllString(u.Path, o.pathRepl)
+			break
+		}
+		// 路径中有编码的字符(如%2F)时按编码后的路径改写,避免被解码成路径分隔符
+		raw := o.pathRegex.ReplaceAllString(u.RawPath, o.pathRepl)
+		if path, err := url.PathUnescape(raw); err == nil {
+			u.Path, u.RawPath = path, raw
+		} else {
+			u.Path, u.RawPath = o.pathRegex.ReplaceAllString(u.Path, o.pathRepl), ""
+		}
+	default:
+		u.Path, u.RawPath = target.Path, target.RawPath
+		return
+	}
+	u.Path, u.RawPath = joinProxyPath(target, u)
+}
+
+// path是否以prefix开头,且在路径段的边界处结束
+func hasProxyPathPrefix(path string, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// 同net/http/httputil中的joinURLPath
+func joinProxyPath(a, b *url.URL) (path, rawpath string) {
+	if a.RawPath == "" && b.RawPath == "" {
+		return singleJoiningSlash(a.Path, b.Path), ""
+	}
+	// Same as singleJoiningSlash, but uses EscapedPath to determine
+	// whether a slash should be added
+	apath := a.EscapedPath()
+	bpath := b.EscapedPath()
+
+	aslash := strings.HasSuffix(apath, "/")
+	bslash := strings.HasPrefix(bpath, "/")
+
+	switch {
+	case aslash && bslash:
+		return a.Path + b.Path[1:], apath + bpath[1:]
+	case !aslash && !bslash:
+		return a.Path + "/" + b.Path, apath + "/" + bpath
+	}
+	return a.Path + b.Path, apath + bpath
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
@@ -0,0 +1,809 @@
+package kit
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHttpProxyReverseHeader(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hasReverseHeader(r.Header) {
+			w.WriteHeader(http.StatusTeapot)
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		HttpProxy(upstream.URL+"/target", w, r)
+	}))
+	defer proxy.Close()
+
+	state, content, err := HttpRawRequest(http.MethodGet, proxy.URL+"/any", nil, nil)
+	if err != nil || state != http.StatusOK || content != "/target" {
+		t.Fatalf("state=%d content=%s err=%v", state, content, err)
+	}
+	state, _, err = HttpRawRequest(http.MethodGet, proxy.URL, map[string]string{REVERSE_HOST: "internal:8080"}, nil)
+	if err != nil || state != http.StatusBadRequest {
+		t.Fatalf("expected spoofed request rejected, state=%d err=%v", state, err)
+	}
+
+	handler := httptest.NewServer(HttpProxyHandler(upstream.URL + "/fixed"))
+	defer handler.Close()
+	state, content, err = HttpRawRequest(http.MethodGet, handler.URL, nil, nil)
+	if err != nil || state != http.StatusOK || content != "/fixed" {
+		t.Fatalf("state=%d content=%s err=%v", state, content, err)
+	}
+	// HttpProxyHandler与HttpProxy同样拒绝携带保留头的请求
+	state, content, err = HttpRawRequest(http.MethodGet, handler.URL, map[string]string{REVERSE_PATH: "/other"}, nil)
+	if err != nil || state != http.StatusBadRequest || content != ErrProxyReverseHeader.Error() {
+		t.Fatalf("expected spoofed request rejected by handler, state=%d content=%s err=%v", state, content, err)
+	}
+}
+
+func TestHttpProxyGuard(t *testing.T) {
+	defer SetupHttp(nil)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	port := upstream.URL[strings.LastIndexByte(upstream.URL, ':'):]
+
+	cases := []struct {
+		config *HttpConfig
+		target string
+		state  int
+	}{
+		{&HttpConfig{ProxyDenyPrivate: true}, upstream.URL, http.StatusForbidden},
+		{&HttpConfig{ProxyDenyPrivate: true}, "http://localhost" + port, http.StatusForbidden},
+		{&HttpConfig{ProxyAllowHosts: []string{"*.example.com"}}, upstream.URL, http.StatusForbidden},
+		{&HttpConfig{ProxyAllowSchemes: []string{"https"}}, upstream.URL, http.StatusForbidden},
+		{&HttpConfig{ProxyAllowCIDRs: []string{"10.0.0.0/8"}}, "http://localhost" + port, http.StatusForbidden},
+		{&HttpConfig{ProxyAllowCIDRs: []string{"127.0.0.0/8", "::1"}}, "http://localhost" + port, http.StatusOK},
+		{&HttpConfig{ProxyAllowHosts: []string{"127.0.0.1"}}, upstream.URL, http.StatusOK},
+	}
+	for i, c := range cases {
+		SetupHttp(c.config)
+		for _, h := range []http.Handler{
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { HttpProxy(c.target, w, r) }),
+			HttpProxyHandler(c.target),
+		} {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			if w.Code != c.state {
+				t.Fatalf("case %d: expected %d, got %d", i, c.state, w.Code)
+			}
+		}
+	}
+}
+
+func TestHttpProxyHandlerPath(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RequestURI()))
+	}))
+	defer upstream.Close()
+
+	cases := []struct {
+		target  string
+		opts    []ProxyOption
+		inbound string
+		expect  string
+	}{
+		{"/base?k=v", nil, "/api/users?a=1", "/base?k=v&a=1"},
+		{"/base/", []ProxyOption{WithProxyPathJoin()}, "/api/users", "/base/api/users"},
+		{"/base", []ProxyOption{WithProxyStripPrefix("/api")}, "/api/users?a=1", "/base/users?a=1"},
+		{"/base", []ProxyOption{WithProxyStripPrefix("/api")}, "/api/a%2Fb", "/base/a%2Fb"},
+		{"/base", []ProxyOption{WithProxyStripPrefix("/api")}, "/apiary/x", "/base/apiary/x"},
+		{"/base", []ProxyOption{WithProxyStripPrefix("/api")}, "/api", "/base/"},
+		{"/base", []ProxyOption{WithProxyStripPrefix("/api/")}, "/api/users", "/base/users"},
+		{"", []ProxyOption{WithProxyPathRegex(`^/v1/(\w+)/(\d+)$`, "/$1/detail/$2")}, "/v1/users/7", "/users/detail/7"},
+		{"", []ProxyOption{WithProxyPathRegex(`^/v1/`, "/")}, "/v1/a%2Fb/c", "/a%2Fb/c"},
+	}
+	for i, c := range cases {
+		w := httptest.NewRecorder()
+		HttpProxyHandler(upstream.URL+c.target, c.opts...).ServeHTTP(w, httptest.NewRequest(http.MethodGet, c.inbound, nil))
+		if got := w.Body.String(); got != c.expect {
+			t.Fatalf("case %d: expected %s, got %s", i, c.expect, got)
+		}
+	}
+}
+
+func TestHttpProxyForwarded(t *testing.T) {
+	defer SetupHttp(nil)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s|%s|%s", r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Forwarded-Host"), r.Header.Get("X-Forwarded-Proto"), r.Header.Get("Forwarded"))
+	}))
+	defer upstream.Close()
+
+	cases := []struct {
+		trusted []string
+		expect  string
+	}{
+		{[]string{"192.0.2.0/24"}, "203.0.113.9, 192.0.2.1|origin.com|https|for=203.0.113.9, for=192.0.2.1;host=example.com;proto=http"},
+		{[]string{ProxyTrusted_None}, "192.0.2.1|example.com|http|for=192.0.2.1;host=example.com;proto=http"},
+	}
+	for i, c := range cases {
+		SetupHttp(&HttpConfig{ProxyForwarded: true, ProxyXForwarded: true, ProxyTrustedCIDRs: c.trusted})
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.Header.Set("X-Forwarded-For", "203.0.113.9")
+		r.Header.Set("X-Forwarded-Host", "origin.com")
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.Header.Set("Forwarded", "for=203.0.113.9")
+		w := httptest.NewRecorder()
+		HttpProxyHandler(upstream.URL).ServeHTTP(w, r)
+		if got := w.Body.String(); got != c.expect {
+			t.Fatalf("case %d: expected %s, got %s", i, c.expect, got)
+		}
+	}
+}
+
+func TestHttpProxyHandlerHost(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	defer upstream.Close()
+
+	cases := []struct {
+		policy string
+		expect string
+	}{
+		{ProxyHost_Inbound, "example.com"},
+		{ProxyHost_Upstream, strings.TrimPrefix(upstream.URL, "http://")},
+		{"fixed.example.com", "fixed.example.com"},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		HttpProxyHandler(upstream.URL, WithProxyHost(c.policy)).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+		if got := w.Body.String(); got != c.expect {
+			t.Fatalf("policy %s: expected %s, got %s", c.policy, c.expect, got)
+		}
+	}
+}
+
+func TestProxyErrorHandler(t *testing.T) {
+	defer SetupHttp(nil)
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	SetupHttp(&HttpConfig{ProxyErrorHandler: ProxyErrorHandler_Json})
+	w := httptest.NewRecorder()
+	HttpProxyHandler(dead.URL).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusBadGateway || w.Header().Get("Content-Type") != "application/problem+json" ||
+		strings.Contains(w.Body.String(), strings.TrimPrefix(dead.URL, "http://")) {
+		t.Fatalf("unexpected json error: %d %v %s", w.Code, w.Header(), w.Body.String())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	w = httptest.NewRecorder()
+	HttpProxyHandler(slow.URL).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504 on timeout, got %d", w.Code)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	w = httptest.NewRecorder()
+	HttpProxyHandler(slow.URL).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	if w.Flushed || w.Body.Len() > 0 || len(w.Header()) > 0 {
+		t.Fatalf("expected nothing written on client cancel, got %d %v", w.Code, w.Header())
+	}
+
+	// 配置引用的处理器需先注册,未注册的名称在Setup时panic
+	name := fmt.Sprintf("teapot-%d", time.Now().UnixNano())
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected panic for unregistered proxy error handler")
+			}
+		}()
+		SetupHttp(&HttpConfig{ProxyErrorHandler: name})
+	}()
+	RegisterProxyErrorHandler(name, func(w http.ResponseWriter, r *http.Request, err error) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	SetupHttp(&HttpConfig{ProxyErrorHandler: name})
+	w = httptest.NewRecorder()
+	HttpProxyHandler(dead.URL).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusTeapot {
+		t.Fatalf("expected custom handler, got %d", w.Code)
+	}
+}
+
+func TestHttpProxyRewrite(t *testing.T) {
+	text := strings.Repeat("hello world ", PROXY_REWRITE_CHUNK_SIZE/4)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Internal", r.Header.Get("X-Added"))
+		switch r.URL.Path {
+		case "/json":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"a":1}`))
+		case "/order":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"z":1,"id":12345678901234567890,"b":"old"}`))
+		case "/large":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"a":"` + strings.Repeat("x", PROXY_INJECT_JSON_LIMIT) + `"}`))
+		case "/empty":
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("Content-Length", "0")
+		case "/gzip":
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			zw.Write([]byte(text))
+			zw.Close()
+		default:
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Content-Length", strconv.Itoa(len(text)))
+			w.Write([]byte(text))
+		}
+	}))
+	defer upstream.Close()
+
+	h := HttpProxyHandler(upstream.URL, WithProxyPathJoin(), WithProxyBodyRewrite(
+		ProxyReplaceBody("world", "gopher"),
+		ProxyInjectJson(map[string]interface{}{"b": "x"}),
+	))
+	expect := strings.Replace(text, "world", "gopher", -1)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/text", nil))
+	if w.Body.String() != expect || w.Header().Get("Content-Length") != "" || w.Header().Get("ETag") != `W/"v1"` {
+		t.Fatalf("unexpected text rewrite: len %d, header %v", w.Body.Len(), w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/json", nil))
+	if w.Body.String() != `{"a":1,"b":"x"}` || w.Header().Get("Content-Length") != "15" {
+		t.Fatalf("unexpected json rewrite: %s %v", w.Body.String(), w.Header())
+	}
+
+	// 保留字段顺序及大数的原文
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/order", nil))
+	if w.Body.String() != `{"z":1,"id":12345678901234567890,"b":"x"}` {
+		t.Fatalf("unexpected json rewrite: %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/large", nil))
+	if w.Body.Len() != PROXY_INJECT_JSON_LIMIT+8 || strings.Contains(w.Body.String(), `"b":"x"`) {
+		t.Fatalf("oversized json should pass through, len %d", w.Body.Len())
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/empty", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Fatalf("unexpected empty gzip rewrite: %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/gzip", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	h.ServeHTTP(w, r)
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := ioutil.ReadAll(zr); string(body) != expect || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("unexpected gzip rewrite: len %d, header %v", len(body), w.Header())
+	}
+
+	// 配置中的头改写规则作用于HttpProxy
+	defer SetupHttp(nil)
+	SetupHttp(&HttpConfig{
+		ProxyRequestHeaders:  &ProxyHeaderRules{Set: map[string]string{"X-Added": "1"}},
+		ProxyResponseHeaders: &ProxyHeaderRules{Remove: []string{"X-Internal"}, Add: map[string]string{"X-Proxy": "kit"}},
+	})
+	w = httptest.NewRecorder()
+	HttpProxy(upstream.URL+"/json", w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Header().Get("X-Internal") != "" || w.Header().Get("X-Proxy") != "kit" {
+		t.Fatalf("unexpected header rewrite: %v", w.Header())
+	}
+}
+
+func TestHttpProxyMirror(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer primary.Close()
+	shadowed := make(chan string, 16)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Hop") != "" || r.Header.Get("Keep-Alive") != "" || r.Header.Get("X-Forwarded-For") != "192.0.2.1" {
+			shadowed <- fmt.Sprintf("unexpected headers: %v", r.Header)
+			return
+		}
+		shadowed <- r.Method + " " + r.URL.Path + " " + string(body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer shadow.Close()
+
+	m := NewProxyMirror(ProxyMirrorConfig{Url: shadow.URL + "/shadow", BodyLimit: 8})
+	defer m.Close()
+	h := HttpProxyHandler(primary.URL, WithProxyPathJoin(), WithProxyMirror(m))
+
+	for _, body := range []string{"", "data", "too large body"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/x", strings.NewReader(body))
+		r.Header.Set("Connection", "X-Hop")
+		r.Header.Set("X-Hop", "1")
+		r.Header.Set("Keep-Alive", "timeout=5")
+		h.ServeHTTP(w, r)
+		if w.Body.String() != body {
+			t.Fatalf("primary response changed: %q", w.Body.String())
+		}
+	}
+	for _, expect := range []string{"POST /shadow/x ", "POST /shadow/x data"} {
+		select {
+		case got := <-shadowed:
+			if got != expect {
+				t.Fatalf("expected shadow %q, got %q", expect, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("shadow request not sent")
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if m.Stats().Sent == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := m.Stats(); st.Sampled != 3 || st.Skipped != 1 || st.Sent != 2 || st.Errors != 0 || st.Status[http.StatusAccepted] != 2 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+
+	// 发送失败只计入Errors
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	dm := NewProxyMirror(ProxyMirrorConfig{Url: dead.URL})
+	defer dm.Close()
+	HttpProxyHandler(primary.URL, WithProxyMirror(dm)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	for i := 0; i < 100 && dm.Stats().Errors == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := dm.Stats(); st.Sent != 0 || st.Errors != 1 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+
+	// percent为0时暂停复制,负数非法
+	zero := 0.0
+	pm := NewProxyMirror(ProxyMirrorConfig{Url: shadow.URL, Percent: &zero})
+	defer pm.Close()
+	HttpProxyHandler(primary.URL, WithProxyMirror(pm)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if st := pm.Stats(); st.Sampled != 0 {
+		t.Fatalf("percent 0 should not mirror: %+v", st)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected panic for negative percent")
+			}
+		}()
+		negative := -1.0
+		NewProxyMirror(ProxyMirrorConfig{Url: shadow.URL, Percent: &negative})
+	}()
+}
+
+func TestProxyRateLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	check := func(l *ProxyRateLimiter, ip string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		l.Check(w, r)
+		return w
+	}
+
+	l := NewProxyRateLimiter(ProxyRateLimit{Rate: 2, Period: time.Second})
+	l.now = func() time.Time { return now }
+	for i, remaining := range []string{"1", "0"} {
+		if w := check(l, "192.0.2.1"); w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Remaining") != remaining {
+			t.Fatalf("request %d: %d %v", i, w.Code, w.Header())
+		}
+	}
+	w := check(l, "192.0.2.1")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" || w.Header().Get("X-RateLimit-Limit") != "2" {
+		t.Fatalf("expected 429: %d %v", w.Code, w.Header())
+	}
+	if w := check(l, "192.0.2.2"); w.Code != http.StatusOK {
+		t.Fatal("other clients should have their own quota")
+	}
+	now = now.Add(500 * time.Millisecond)
+	if w := check(l, "192.0.2.1"); w.Code != http.StatusOK {
+		t.Fatal("token should be refilled after half period")
+	}
+
+	// 令牌桶的Limit为Burst,Remaining不超过Limit
+	l = NewProxyRateLimiter(ProxyRateLimit{Rate: 1, Period: time.Second, Burst: 5})
+	l.now = func() time.Time { return now }
+	if w := check(l, "192.0.2.1"); w.Header().Get("X-RateLimit-Limit") != "5" || w.Header().Get("X-RateLimit-Remaining") != "4" {
+		t.Fatalf("unexpected burst headers: %v", w.Header())
+	}
+
+	l = NewProxyRateLimiter(ProxyRateLimit{Algorithm: ProxyRateLimit_Window, Rate: 4, Period: time.Second, Key: ProxyRateKey_Route})
+	l.now = func() time.Time { return now }
+	for i := 0; i < 4; i++ {
+		if w := check(l, fmt.Sprintf("192.0.2.%d", i)); w.Code != http.StatusOK {
+			t.Fatalf("request %d limited", i)
+		}
+	}
+	if w := check(l, "192.0.2.9"); w.Code != http.StatusTooManyRequests {
+		t.Fatal("route quota should be shared by all clients")
+	}
+	// 下个窗口开始时上个窗口的4个请求仍全部计入
+	now = now.Add(time.Second)
+	if w := check(l, "192.0.2.1"); w.Code != http.StatusTooManyRequests {
+		t.Fatal("sliding window should still count the previous window")
+	}
+	now = now.Add(500 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if w := check(l, "192.0.2.1"); w.Code != http.StatusOK {
+			t.Fatalf("request %d in the middle of the window limited", i)
+		}
+	}
+	if w := check(l, "192.0.2.1"); w.Code != http.StatusTooManyRequests {
+		t.Fatal("expected half of the previous window to be counted")
+	}
+
+	// 达到MaxKeys时不淘汰仍在限流中的key,新key共享额度;恢复全部额度后按最近使用淘汰
+	l = NewProxyRateLimiter(ProxyRateLimit{Rate: 1, Period: time.Second, MaxKeys: 2})
+	l.now = func() time.Time { return now }
+	check(l, "192.0.2.1")
+	check(l, "192.0.2.2")
+	if w := check(l, "192.0.2.3"); w.Code != http.StatusOK {
+		t.Fatal("first key beyond MaxKeys should use the shared quota")
+	}
+	if w := check(l, "192.0.2.4"); w.Code != http.StatusTooManyRequests {
+		t.Fatal("keys beyond MaxKeys should share one quota")
+	}
+	if w := check(l, "192.0.2.1"); w.Code != http.StatusTooManyRequests {
+		t.Fatal("active key should not be reset by eviction")
+	}
+	now = now.Add(time.Second)
+	check(l, "192.0.2.2")
+	if w := check(l, "192.0.2.5"); w.Code != http.StatusOK || l.states["192.0.2.5"] == nil || l.states["192.0.2.1"] != nil {
+		t.Fatalf("expected least recently used idle key evicted: %d %v", w.Code, l.states)
+	}
+
+	// 只有来自proxyTrustedCIDRs的请求才按X-Forwarded-For识别客户端
+	defer SetupHttp(nil)
+	SetupHttp(&HttpConfig{ProxyTrustedCIDRs: []string{"10.0.0.0/8"}})
+	forwarded := func(remote, xff string) string {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remote + ":1234"
+		r.Header.Set("X-Forwarded-For", xff)
+		return proxyKeyValue(ProxyHashKey_IP, r)
+	}
+	if ip := forwarded("10.0.0.1", "203.0.113.9, 198.51.100.7, 10.0.0.2"); ip != "198.51.100.7" {
+		t.Fatalf("unexpected client ip via trusted proxies: %s", ip)
+	}
+	if ip := forwarded("192.0.2.1", "198.51.100.7"); ip != "192.0.2.1" {
+		t.Fatalf("untrusted client should not set its ip: %s", ip)
+	}
+	SetupHttp(nil)
+	if ip := forwarded("10.0.0.1", "198.51.100.7"); ip != "10.0.0.1" {
+		t.Fatalf("trusting all clients should not use X-Forwarded-For: %s", ip)
+	}
+}
+
+func TestProxyCache(t *testing.T) {
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		switch r.URL.Path {
+		case "/nostore":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/slow":
+			time.Sleep(50 * time.Millisecond)
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/slownostore":
+			time.Sleep(50 * time.Millisecond)
+			w.Header().Set("Cache-Control", "no-store")
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			if v := r.Header.Get("X-Vary"); v != "" {
+				w.Header().Set("Vary", v)
+			}
+			w.Header().Set("X-Upstream", "1")
+		default:
+			w.Header().Set("Cache-Control", "max-age=60, stale-while-revalidate=30")
+			w.Header().Set("Vary", "Accept-Language")
+		}
+		fmt.Fprintf(w, "%s %d", r.Header.Get("Accept-Language"), n)
+	}))
+	defer upstream.Close()
+
+	now := time.Now()
+	c := NewProxyCache(ProxyCacheConfig{})
+	c.now = func() time.Time { return now }
+	h := c.Handler(HttpProxyHandler(upstream.URL, WithProxyPathJoin()))
+	serve := func(path string, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	expect := func(w *httptest.ResponseRecorder, status string, body string) {
+		t.Helper()
+		if got := w.Header().Get(PROXY_CACHE_STATUS_HEADER); got != status || w.Body.String() != body {
+			t.Fatalf("expected %s %q, got %s %q", status, body, got, w.Body.String())
+		}
+	}
+
+	expect(serve("/a", nil), ProxyCache_Miss, " 1")
+	now = now.Add(5 * time.Second)
+	w := serve("/a", nil)
+	expect(w, ProxyCache_Hit, " 1")
+	if w.Header().Get("Age") != "5" {
+		t.Fatalf("unexpected age: %v", w.Header())
+	}
+	expect(serve("/a", map[string]string{"Accept-Language": "zh"}), ProxyCache_Miss, "zh 2")
+	expect(serve("/a", map[string]string{"Accept-Language": "zh"}), ProxyCache_Hit, "zh 2")
+	expect(serve("/a", map[string]string{"Authorization": "token"}), ProxyCache_Bypass, " 3")
+
+	// 过期后先返回旧响应,后台刷新
+	now = now.Add(60 * time.Second)
+	expect(serve("/a", nil), ProxyCache_Stale, " 1")
+	for i := 0; i < 100 && atomic.LoadInt32(&hits) < 4; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 100; i++ {
+		if w = serve("/a", nil); w.Header().Get(PROXY_CACHE_STATUS_HEADER) == ProxyCache_Hit {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	expect(w, ProxyCache_Hit, " 4")
+
+	expect(serve("/nostore", nil), ProxyCache_Miss, " 5")
+	expect(serve("/nostore", nil), ProxyCache_Miss, " 6")
+
+	// 并发未命中只请求一次上游
+	atomic.StoreInt32(&hits, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w := serve("/slow", nil); w.Body.String() != " 1" {
+				t.Errorf("unexpected coalesced body %q", w.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Fatalf("expected 1 upstream request, got %d", n)
+	}
+
+	// 不可缓存的响应不串行化并发请求
+	atomic.StoreInt32(&hits, 0)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve("/slownostore", nil)
+		}()
+	}
+	wg.Wait()
+	if n, d := atomic.LoadInt32(&hits), time.Since(start); n != 10 || d > 300*time.Millisecond {
+		t.Fatalf("uncacheable requests should run in parallel: %d requests in %v", n, d)
+	}
+
+	// 外层设置的响应头不缓存
+	outer := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Outer", r.Header.Get("X-Outer"))
+		h.ServeHTTP(w, r)
+	})
+	serveOuter := func(v string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/vary", nil)
+		r.Header.Set("X-Outer", v)
+		w := httptest.NewRecorder()
+		outer.ServeHTTP(w, r)
+		return w
+	}
+	serveOuter("1")
+	if w = serveOuter("2"); w.Header().Get(PROXY_CACHE_STATUS_HEADER) != ProxyCache_Hit ||
+		w.Header().Get("X-Outer") != "2" || w.Header().Get("X-Upstream") != "1" {
+		t.Fatalf("unexpected cached header: %v", w.Header())
+	}
+
+	// Vary变化时丢弃旧的版本
+	c.Purge()
+	serve("/vary", map[string]string{"X-Vary": "Accept", "Accept": "a"})
+	serve("/vary", map[string]string{"X-Vary": "Accept", "Accept": "b"})
+	if n := c.lru.Len(); n != 2 {
+		t.Fatalf("expected 2 variants, got %d", n)
+	}
+	serve("/vary", map[string]string{"X-Vary": "Accept-Language", "Accept": "c"})
+	if n := c.lru.Len(); n != 1 {
+		t.Fatalf("old variants should be dropped, got %d entries", n)
+	}
+}
+
+func TestProxyCacheUpgrade(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+		line, _ := rw.ReadString('\n')
+		rw.WriteString(line)
+		rw.Flush()
+	}))
+	defer upstream.Close()
+	front := httptest.NewServer(NewProxyCache(ProxyCacheConfig{}).Handler(HttpProxyHandler(upstream.URL)))
+	defer front.Close()
+
+	conn, err := net.Dial("tcp", front.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	br := bufio.NewReader(conn)
+	rsp, err := http.ReadResponse(br, nil)
+	if err != nil || rsp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected upgrade through cache: %v %v", rsp, err)
+	}
+	fmt.Fprintf(conn, "ping\n")
+	if line, _ := br.ReadString('\n'); line != "ping\n" {
+		t.Fatalf("unexpected echo %q", line)
+	}
+}
+
+func TestProxyCompressor(t *testing.T) {
+	text := strings.Repeat("hello world ", 200)
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"a":1}`))
+		case "/png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte(text))
+		case "/vary":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "accept-encoding")
+			w.Write([]byte(text))
+		case "/stream":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("first"))
+			w.(http.Flusher).Flush()
+			<-release
+			w.Write([]byte("second"))
+		default:
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte(text))
+		}
+	}))
+	defer upstream.Close()
+
+	c := NewProxyCompressor(ProxyCompressConfig{})
+	h := c.Handler(HttpProxyHandler(upstream.URL, WithProxyPathJoin()))
+	get := func(path, accept string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if accept != "" {
+			r.Header.Set("Accept-Encoding", accept)
+		}
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/text", "gzip, br")
+	if w.Header().Get("Content-Encoding") != "br" || w.Header().Get("ETag") != `W/"v1"` || w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("unexpected br header: %v", w.Header())
+	}
+	if body, _ := ioutil.ReadAll(brotli.NewReader(w.Body)); string(body) != text {
+		t.Fatalf("unexpected br body: len %d", len(body))
+	}
+
+	w = get("/text", "br;q=0.5, gzip")
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("unexpected gzip header: %v", w.Header())
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := ioutil.ReadAll(zr); string(body) != text {
+		t.Fatalf("unexpected gzip body: len %d", len(body))
+	}
+
+	for _, tc := range []struct{ path, accept, body string }{
+		{"/text", "", text},
+		{"/text", "identity, *;q=0", text},
+		{"/small", "gzip", `{"a":1}`},
+		{"/png", "gzip", text},
+	} {
+		w = get(tc.path, tc.accept)
+		if w.Header().Get("Content-Encoding") != "" || w.Body.String() != tc.body ||
+			w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Fatalf("unexpected compression of %s with %q: %v", tc.path, tc.accept, w.Header())
+		}
+	}
+
+	// 上游已有Vary时不重复添加,内层的缓存不按Accept-Encoding区分版本
+	cache := NewProxyCache(ProxyCacheConfig{})
+	h = c.Handler(cache.Handler(HttpProxyHandler(upstream.URL, WithProxyPathJoin())))
+	for _, accept := range []string{"gzip", "br", "", "gzip"} {
+		if w = get("/vary", accept); len(w.Header()["Vary"]) != 1 {
+			t.Fatalf("unexpected vary with %q: %v", accept, w.Header())
+		}
+	}
+	if n := cache.lru.Len(); n != 3 || w.Header().Get(PROXY_CACHE_STATUS_HEADER) != ProxyCache_Hit {
+		t.Fatalf("expected a variant per upstream Vary, got %d entries: %v", n, w.Header())
+	}
+	h = c.Handler(cache.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(text))
+	})))
+	get("/novary", "gzip")
+	if w = get("/novary", "br"); w.Header().Get(PROXY_CACHE_STATUS_HEADER) != ProxyCache_Hit || w.Header().Get("Content-Encoding") != "br" {
+		t.Fatalf("compressor vary should not split the cache: %v", w.Header())
+	}
+
+	// 上游Flush时压缩器同时刷新,客户端无需等待响应结束
+	defer SetupHttp(nil)
+	SetupHttp(&HttpConfig{ProxyFlushInterval: -1, ProxyCompress: &ProxyCompressConfig{Encodings: []string{ProxyEncoding_Gzip}}})
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		HttpProxy(upstream.URL+"/stream", w, r)
+	}))
+	defer front.Close()
+	req, _ := http.NewRequest(http.MethodGet, front.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	if zr, err = gzip.NewReader(rsp.Body); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(zr, buf); err != nil || string(buf) != "first" {
+		t.Fatalf("unexpected streamed chunk: %q %v", buf, err)
+	}
+	close(release)
+	if rest, _ := ioutil.ReadAll(zr); string(rest) != "second" {
+		t.Fatalf("unexpected rest: %q", rest)
+	}
+}
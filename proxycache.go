@@ -0,0 +1,591 @@
+package kit
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PROXY_CACHE_MAX_BYTES      = 64 * 1024 * 1024
+	PROXY_CACHE_MAX_ENTRY_SIZE = 1024 * 1024
+	PROXY_CACHE_STATUS_HEADER  = "X-Cache"
+	PROXY_CACHE_PASS_TTL       = 10 * time.Second // 不可缓存的响应在该时间内不再合并并发请求
+
+	ProxyCache_Hit    = "HIT"    // 命中新鲜的缓存
+	ProxyCache_Stale  = "STALE"  // 返回过期的缓存,同时在后台重新验证
+	ProxyCache_Miss   = "MISS"   // 未命中,转发给上游
+	ProxyCache_Bypass = "BYPASS" // 请求不可缓存,直接转发给上游
+)
+
+/*
+代理响应的内存缓存:
+1. 只缓存GET的200/203/204/301/404/410响应,且需要Cache-Control的max-age/s-maxage,Expires或DefaultTTL
+2. 不缓存no-store,no-cache,private,带Set-Cookie或Vary: *的响应,请求带Authorization,no-cache/no-store或升级协议(如websocket)时不使用缓存
+3. 按Vary中的请求头区分同一URL的多个版本
+4. 过期后stale-while-revalidate时间内先返回旧响应并在后台刷新
+5. 同一版本的并发未命中只有一个请求转发给上游,其余等待其结果;响应不可缓存时等待的请求随即直接转发,
+之后PROXY_CACHE_PASS_TTL内的请求也不再合并
+6. 超过MaxBytes时按LRU淘汰
+7. 只缓存上游的响应头,外层处理器(如限流)在之前设置的响应头不会被缓存
+*/
+type ProxyCacheConfig struct {
+	MaxBytes             int64         `json:"maxBytes" yaml:"maxBytes"`
+	MaxEntrySize         int64         `json:"maxEntrySize" yaml:"maxEntrySize"`
+	DefaultTTL           time.Duration `json:"defaultTTL" yaml:"defaultTTL"`                     // 响应没有声明有效期时的缓存时间,默认不缓存
+	StaleWhileRevalidate time.Duration `json:"staleWhileRevalidate" yaml:"staleWhileRevalidate"` // 响应没有声明stale-while-revalidate时使用
+	StatusHeader         string        `json:"statusHeader" yaml:"statusHeader"`                 // 默认X-Cache
+}
+
+type proxyCacheEntry struct {
+	key          string
+	ukey         string
+	pass         bool // 响应不可缓存的标记,有效期内直接转发
+	status       int
+	header       http.Header
+	body         []byte
+	stored       time.Time
+	ttl          time.Duration
+	swr          time.Duration
+	revalidating bool
+}
+
+func (e *proxyCacheEntry) size() int64 {
+	n := int64(len(e.key) + len(e.body))
+	for k, vs := range e.header {
+		for _, v := range vs {
+			n += int64(len(k) + len(v))
+		}
+	}
+	return n
+}
+
+type proxyCacheCall struct {
+	done        chan struct{}
+	uncacheable bool // 在done关闭前设置
+}
+
+// 同一URL的Vary请求头及已缓存的版本,Vary变化时丢弃旧的版本
+type proxyCacheVary struct {
+	names []string
+	keys  map[string]bool
+}
+
+type ProxyCache struct {
+	config ProxyCacheConfig
+	mutex  sync.Mutex
+	lru    *list.List                 // 最近使用的在前
+	items  map[string]*list.Element   // 版本key -> *proxyCacheEntry
+	varies map[string]*proxyCacheVary // url key -> Vary中的请求头及版本key
+	calls  map[string]*proxyCacheCall
+	bytes  int64
+	now    func() time.Time
+}
+
+func NewProxyCache(c ProxyCacheConfig) *ProxyCache {
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = PROXY_CACHE_MAX_BYTES
+	}
+	if c.MaxEntrySize <= 0 {
+		c.MaxEntrySize = PROXY_CACHE_MAX_ENTRY_SIZE
+	}
+	if c.StatusHeader == "" {
+		c.StatusHeader = PROXY_CACHE_STATUS_HEADER
+	}
+	return &ProxyCache{
+		config: c,
+		lru:    list.New(),
+		items:  make(map[string]*list.Element),
+		varies: make(map[string]*proxyCacheVary),
+		calls:  make(map[string]*proxyCacheCall),
+		now:    time.Now,
+	}
+}
+
+// 在next(通常为代理处理器)之前查找缓存
+func (c *ProxyCache) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.serve(w, r, next)
+	})
+}
+
+func (c *ProxyCache) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || !cacheableProxyRequest(r) {
+		w.Header().Set(c.config.StatusHeader, ProxyCache_Bypass)
+		next.ServeHTTP(w, r)
+		return
+	}
+	ukey := r.Host + r.URL.RequestURI()
+	for {
+		c.mutex.Lock()
+		vkey := proxyCacheVaryKey(ukey, c.varyNames(ukey), r.Header)
+		if e := c.get(vkey); e != nil {
+			age := c.now().Sub(e.stored)
+			if e.pass {
+				if age < e.ttl {
+					c.mutex.Unlock()
+					c.fetch(w, r, next, ukey, nil)
+					return
+				}
+			} else if age < e.ttl {
+				c.mutex.Unlock()
+				c.write(w, r, e, age, ProxyCache_Hit)
+				return
+			} else if age < e.ttl+e.swr {
+				if !e.revalidating {
+					e.revalidating = true
+					go c.revalidate(r, next, ukey)
+				}
+				c.mutex.Unlock()
+				c.write(w, r, e, age, ProxyCache_Stale)
+				return
+			}
+		}
+		if r.Method == http.MethodHead {
+			c.mutex.Unlock()
+			w.Header().Set(c.config.StatusHeader, ProxyCache_Miss)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if call, ok := c.calls[vkey]; ok {
+			// 等待正在进行的请求,可缓存时重新查找,否则直接转发
+			c.mutex.Unlock()
+			select {
+			case <-call.done:
+				if call.uncacheable {
+					c.fetch(w, r, next, ukey, nil)
+					return
+				}
+				continue
+			case <-r.Context().Done():
+				// 与未合并的请求一致,超时返回504,客户端断开只记录日志
+				httpDynamicErrorHandler(w, r, r.Context().Err())
+				return
+			}
+		}
+		call := &proxyCacheCall{done: make(chan struct{})}
+		c.calls[vkey] = call
+		c.mutex.Unlock()
+		c.fetch(w, r, next, ukey, call)
+		return
+	}
+}
+
+// 转发给上游并保存响应,call不为nil时结束后通知等待的请求
+func (c *ProxyCache) fetch(w http.ResponseWriter, r *http.Request, next http.Handler, ukey string, call *proxyCacheCall) {
+	w.Header().Set(c.config.StatusHeader, ProxyCache_Miss)
+	cw := c.newWriter(w)
+	stored := false
+	if call != nil {
+		defer func() {
+			c.mutex.Lock()
+			for k, v := range c.calls {
+				if v == call {
+					delete(c.calls, k)
+				}
+			}
+			call.uncacheable = !stored
+			c.mutex.Unlock()
+			close(call.done)
+		}()
+	}
+	next.ServeHTTP(cw, r)
+	stored = c.store(ukey, r, cw.status, cw.header, &cw.buf, cw.overflow)
+}
+
+func (c *ProxyCache) write(w http.ResponseWriter, r *http.Request, e *proxyCacheEntry, age time.Duration, status string) {
+	h := w.Header()
+	for k, vs := range e.header {
+		h[k] = append([]string(nil), vs...)
+	}
+	h.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	h.Set(c.config.StatusHeader, status)
+	w.WriteHeader(e.status)
+	if r.Method != http.MethodHead {
+		w.Write(e.body)
+	}
+}
+
+// 在后台重新请求上游并更新缓存
+func (c *ProxyCache) revalidate(r *http.Request, next http.Handler, ukey string) {
+	req := r.Clone(context.Background())
+	rw := c.newWriter(&proxyCacheRecorder{header: make(http.Header)})
+	stored := false
+	defer func() {
+		recover() // ReverseProxy在复制body失败时以http.ErrAbortHandler panic
+		if !stored {
+			// 允许之后的请求再次刷新
+			c.mutex.Lock()
+			if e := c.get(proxyCacheVaryKey(ukey, c.varyNames(ukey), req.Header)); e != nil {
+				e.revalidating = false
+			}
+			c.mutex.Unlock()
+		}
+	}()
+	next.ServeHTTP(rw, req)
+	stored = c.store(ukey, req, rw.status, rw.header, &rw.buf, rw.overflow)
+}
+
+func (c *ProxyCache) newWriter(w http.ResponseWriter) *proxyCacheWriter {
+	return &proxyCacheWriter{
+		ResponseWriter: w,
+		limit:          c.config.MaxEntrySize,
+		statusHeader:   c.config.StatusHeader,
+		outer:          w.Header().Clone(),
+	}
+}
+
+/*
+保存可缓存的响应,返回是否保存. 上游的响应不可缓存时保存不可缓存的标记,
+没有响应(如客户端断开)时不做处理
+*/
+func (c *ProxyCache) store(ukey string, r *http.Request, status int, header http.Header, body *bytes.Buffer, overflow bool) bool {
+	if header == nil {
+		return false
+	}
+	vary, ok := proxyCacheVaryNames(header)
+	if !ok || overflow || !cacheableProxyStatus(status) {
+		c.markPass(ukey, r)
+		return false
+	}
+	ttl, swr, ok := proxyCacheFreshness(header, c.now())
+	if !ok {
+		ttl = c.config.DefaultTTL
+	}
+	if ttl <= 0 {
+		c.markPass(ukey, r)
+		return false
+	}
+	if swr < 0 {
+		swr = c.config.StaleWhileRevalidate
+	}
+	e := &proxyCacheEntry{
+		ukey:   ukey,
+		status: status,
+		header: header,
+		body:   append([]byte(nil), body.Bytes()...),
+		stored: c.now(),
+		ttl:    ttl,
+		swr:    swr,
+	}
+	e.key = proxyCacheVaryKey(ukey, vary, r.Header)
+	if e.size() > c.config.MaxEntrySize {
+		c.markPass(ukey, r)
+		return false
+	}
+	c.mutex.Lock()
+	c.insert(vary, e)
+	c.mutex.Unlock()
+	return true
+}
+
+func (c *ProxyCache) markPass(ukey string, r *http.Request) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	vary := c.varyNames(ukey)
+	c.insert(vary, &proxyCacheEntry{
+		key:    proxyCacheVaryKey(ukey, vary, r.Header),
+		ukey:   ukey,
+		pass:   true,
+		stored: c.now(),
+		ttl:    PROXY_CACHE_PASS_TTL,
+	})
+}
+
+// 需持有c.mutex
+func (c *ProxyCache) varyNames(ukey string) []string {
+	if v := c.varies[ukey]; v != nil {
+		return v.names
+	}
+	return nil
+}
+
+// 需持有c.mutex. Vary变化时先删除该URL的旧版本
+func (c *ProxyCache) insert(vary []string, e *proxyCacheEntry) {
+	v := c.varies[e.ukey]
+	if v != nil && !equalProxyCacheVary(v.names, vary) {
+		for k := range v.keys {
+			c.remove(c.items[k])
+		}
+		v = nil
+	}
+	if el, ok := c.items[e.key]; ok {
+		c.remove(el)
+	}
+	if v = c.varies[e.ukey]; v == nil {
+		v = &proxyCacheVary{names: vary, keys: make(map[string]bool)}
+		c.varies[e.ukey] = v
+	}
+	v.keys[e.key] = true
+	c.items[e.key] = c.lru.PushFront(e)
+	c.bytes += e.size()
+	for c.bytes > c.config.MaxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// 需持有c.mutex
+func (c *ProxyCache) get(key string) *proxyCacheEntry {
+	if el, ok := c.items[key]; ok {
+		c.lru.MoveToFront(el)
+		return el.Value.(*proxyCacheEntry)
+	}
+	return nil
+}
+
+// 需持有c.mutex
+func (c *ProxyCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*proxyCacheEntry)
+	delete(c.items, e.key)
+	c.bytes -= e.size()
+	if v := c.varies[e.ukey]; v != nil {
+		if delete(v.keys, e.key); len(v.keys) == 0 {
+			delete(c.varies, e.ukey)
+		}
+	}
+}
+
+// 清空缓存
+func (c *ProxyCache) Purge() {
+	c.mutex.Lock()
+	c.lru.Init()
+	c.items = make(map[string]*list.Element)
+	c.varies = make(map[string]*proxyCacheVary)
+	c.bytes = 0
+	c.mutex.Unlock()
+}
+
+// 返回响应Vary中的请求头,Vary: *时ok为false
+func proxyCacheVaryNames(header http.Header) (vary []string, ok bool) {
+	for _, v := range header["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name == "*" {
+				return nil, false
+			} else if name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return vary, true
+}
+
+func equalProxyCacheVary(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func proxyCacheVaryKey(ukey string, vary []string, header http.Header) string {
+	if len(vary) == 0 {
+		return ukey
+	}
+	buf := GetBytesBuffer()
+	defer PutBytesBuffer(buf)
+	buf.WriteString(ukey)
+	for _, name := range vary {
+		buf.WriteByte(0)
+		buf.WriteString(strings.Join(header[name], ","))
+	}
+	return buf.String()
+}
+
+func cacheableProxyRequest(r *http.Request) bool {
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	for _, v := range r.Header["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(name), "upgrade") {
+				return false
+			}
+		}
+	}
+	for _, d := range parseCacheControl(r.Header) {
+		if d.name == "no-store" || d.name == "no-cache" {
+			return false
+		}
+	}
+	return !strings.Contains(r.Header.Get("Pragma"), "no-cache")
+}
+
+func cacheableProxyStatus(status int) bool {
+	switch status {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent,
+		http.StatusMovedPermanently, http.StatusNotFound, http.StatusGone:
+		return true
+	}
+	return false
+}
+
+type cacheDirective struct {
+	name  string
+	value string
+}
+
+func parseCacheControl(header http.Header) (rets []cacheDirective) {
+	for _, v := range header["Cache-Control"] {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+			name, value := d, ""
+			if i := strings.IndexByte(d, '='); i >= 0 {
+				name, value = d[:i], strings.Trim(d[i+1:], `"`)
+			}
+			rets = append(rets, cacheDirective{name: strings.ToLower(name), value: value})
+		}
+	}
+	return
+}
+
+/*
+按响应头计算有效期及stale-while-revalidate时间,没有声明有效期时ok为false,
+没有声明stale-while-revalidate时swr为-1. 不可缓存的响应ttl为0
+*/
+func proxyCacheFreshness(header http.Header, now time.Time) (ttl time.Duration, swr time.Duration, ok bool) {
+	if header.Get("Set-Cookie") != "" {
+		return 0, 0, true
+	}
+	swr = -1
+	maxAge, sMaxAge := -1, -1
+	for _, d := range parseCacheControl(header) {
+		switch d.name {
+		case "no-store", "no-cache", "private":
+			return 0, 0, true
+		case "max-age":
+			if n, err := strconv.Atoi(d.value); err == nil {
+				maxAge = n
+			}
+		case "s-maxage":
+			if n, err := strconv.Atoi(d.value); err == nil {
+				sMaxAge = n
+			}
+		case "stale-while-revalidate":
+			if n, err := strconv.Atoi(d.value); err == nil {
+				swr = time.Duration(n) * time.Second
+			}
+		}
+	}
+	switch {
+	case sMaxAge >= 0:
+		return time.Duration(sMaxAge) * time.Second, swr, true
+	case maxAge >= 0:
+		return time.Duration(maxAge) * time.Second, swr, true
+	}
+	if v := header.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			return 0, swr, true // 非法的Expires表示已过期
+		}
+		date := now
+		if d, err := http.ParseTime(header.Get("Date")); err == nil {
+			date = d
+		}
+		return expires.Sub(date), swr, true
+	}
+	return 0, swr, false
+}
+
+// 将响应写给客户端的同时复制一份用于缓存
+type proxyCacheWriter struct {
+	http.ResponseWriter
+	limit        int64
+	statusHeader string
+	outer        http.Header // 调用next前已有的响应头,由外层处理器设置,不缓存
+	status       int
+	header       http.Header
+	buf          bytes.Buffer
+	overflow     bool
+}
+
+func (w *proxyCacheWriter) WriteHeader(status int) {
+	if w.header == nil {
+		w.status = status
+		w.header = make(http.Header)
+		for k, vs := range w.ResponseWriter.Header() {
+			if added := proxyCacheAddedValues(w.outer[k], vs); len(added) > 0 {
+				w.header[k] = added
+			}
+		}
+		w.header.Del(w.statusHeader)
+		w.header.Del("Age")
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// 返回next添加或修改的值: 在外层的值之后追加时只返回追加的部分,被修改时返回全部
+func proxyCacheAddedValues(outer, vs []string) []string {
+	if len(vs) < len(outer) {
+		return append([]string(nil), vs...)
+	}
+	for i := range outer {
+		if outer[i] != vs[i] {
+			return append([]string(nil), vs...)
+		}
+	}
+	return append([]string(nil), vs[len(outer):]...)
+}
+
+func (w *proxyCacheWriter) Write(p []byte) (int, error) {
+	if w.header == nil {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.overflow {
+		if int64(w.buf.Len()+len(p)) > w.limit {
+			w.overflow = true
+			w.buf = bytes.Buffer{}
+		} else {
+			w.buf.Write(p)
+		}
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *proxyCacheWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// 升级协议的请求已直接转发,经过proxyCacheWriter时也能找到底层的连接
+func (w *proxyCacheWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hj.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+// 供http.ResponseController查找底层的ResponseWriter
+func (w *proxyCacheWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// 后台刷新时丢弃响应
+type proxyCacheRecorder struct {
+	header http.Header
+}
+
+func (r *proxyCacheRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *proxyCacheRecorder) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (r *proxyCacheRecorder) WriteHeader(status int) {
+}
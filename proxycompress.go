@@ -0,0 +1,329 @@
+package kit
+
+import (
+	"bufio"
+	"compress/gzip"
+	"github.com/andybalholm/brotli"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	ProxyEncoding_Brotli = "br"
+	ProxyEncoding_Gzip   = "gzip"
+
+	PROXY_COMPRESS_MIN_SIZE       = 1024
+	PROXY_COMPRESS_BROTLI_QUALITY = 4 // 兼顾压缩率与速度,适合实时压缩
+)
+
+// 默认压缩的Content-Type,"text/"结尾表示前缀匹配
+var proxyCompressTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/x-ndjson",
+	"application/problem+json",
+	"image/svg+xml",
+}
+
+/*
+按Accept-Encoding实时压缩未压缩的代理响应:
+1. Encodings为服务端的优先顺序,默认br,gzip,客户端q值相同时按此顺序选择
+2. 只压缩Types中的Content-Type,已有Content-Encoding或Cache-Control: no-transform的响应不压缩
+3. Content-Length小于MinSize的响应不压缩,长度未知时缓存前MinSize字节再判断,期间Flush则立即开始压缩
+4. 代理的Flush(由ProxyFlushInterval控制)会同时刷新压缩器,流式响应不会被压缩缓冲阻塞
+5. 在写出响应头时添加Vary: Accept-Encoding,上游已有时不重复添加
+*/
+type ProxyCompressConfig struct {
+	Encodings     []string `json:"encodings" yaml:"encodings"`
+	Types         []string `json:"types" yaml:"types"`
+	MinSize       int      `json:"minSize" yaml:"minSize"`
+	GzipLevel     int      `json:"gzipLevel" yaml:"gzipLevel"`         // 默认gzip.DefaultCompression
+	BrotliQuality int      `json:"brotliQuality" yaml:"brotliQuality"` // 默认4
+}
+
+type ProxyCompressor struct {
+	config     ProxyCompressConfig
+	gzipPool   sync.Pool
+	brotliPool sync.Pool
+}
+
+// 配置非法时panic
+func NewProxyCompressor(c ProxyCompressConfig) *ProxyCompressor {
+	if len(c.Encodings) == 0 {
+		c.Encodings = []string{ProxyEncoding_Brotli, ProxyEncoding_Gzip}
+	}
+	for _, e := range c.Encodings {
+		if e != ProxyEncoding_Brotli && e != ProxyEncoding_Gzip {
+			panic("invalid proxy compress encoding: " + e)
+		}
+	}
+	if len(c.Types) == 0 {
+		c.Types = proxyCompressTypes
+	}
+	if c.MinSize <= 0 {
+		c.MinSize = PROXY_COMPRESS_MIN_SIZE
+	}
+	if c.GzipLevel == 0 {
+		c.GzipLevel = gzip.DefaultCompression
+	}
+	if c.GzipLevel < gzip.HuffmanOnly || c.GzipLevel > gzip.BestCompression {
+		panic("invalid proxy compress gzip level: " + strconv.Itoa(c.GzipLevel))
+	}
+	if c.BrotliQuality <= 0 {
+		c.BrotliQuality = PROXY_COMPRESS_BROTLI_QUALITY
+	}
+	if c.BrotliQuality > brotli.BestCompression {
+		panic("invalid proxy compress brotli quality: " + strconv.Itoa(c.BrotliQuality))
+	}
+	p := &ProxyCompressor{config: c}
+	p.gzipPool.New = func() interface{} {
+		zw, _ := gzip.NewWriterLevel(nil, c.GzipLevel)
+		return zw
+	}
+	p.brotliPool.New = func() interface{} {
+		return brotli.NewWriterLevel(nil, c.BrotliQuality)
+	}
+	return p
+}
+
+// 压缩next(通常为代理处理器)的响应
+func (p *ProxyCompressor) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := p.negotiate(r.Header.Get("Accept-Encoding"))
+		if r.Method == http.MethodHead {
+			encoding = ""
+		}
+		// 不压缩时也经过proxyCompressWriter,以便在写出响应头时添加Vary
+		cw := &proxyCompressWriter{ResponseWriter: w, compressor: p, encoding: encoding}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// 按Accept-Encoding的q值及服务端的优先顺序选择编码,没有可用的编码时返回空字符串
+func (p *ProxyCompressor) negotiate(accept string) string {
+	if accept == "" {
+		return ""
+	}
+	qs := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		name, q := strings.TrimSpace(part), 1.0
+		if i := strings.IndexByte(name, ';'); i >= 0 {
+			params := strings.TrimSpace(name[i+1:])
+			name = strings.TrimSpace(name[:i])
+			if strings.HasPrefix(params, "q=") {
+				if v, err := strconv.ParseFloat(params[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		qs[strings.ToLower(name)] = q
+	}
+	best, bestQ := "", 0.0
+	for _, e := range p.config.Encodings {
+		q, ok := qs[e]
+		if !ok {
+			q = qs["*"]
+		}
+		if q > bestQ {
+			best, bestQ = e, q
+		}
+	}
+	return best
+}
+
+func (p *ProxyCompressor) compressible(header http.Header) bool {
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+	if strings.Contains(strings.ToLower(header.Get("Cache-Control")), "no-transform") {
+		return false
+	}
+	mt, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, t := range p.config.Types {
+		if t == mt || (strings.HasSuffix(t, "/") && strings.HasPrefix(mt, t)) {
+			return true
+		}
+	}
+	return false
+}
+
+type proxyEncoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+func (p *ProxyCompressor) getEncoder(encoding string, w io.Writer) proxyEncoder {
+	var zw proxyEncoder
+	if encoding == ProxyEncoding_Brotli {
+		zw = p.brotliPool.Get().(*brotli.Writer)
+	} else {
+		zw = p.gzipPool.Get().(*gzip.Writer)
+	}
+	zw.Reset(w)
+	return zw
+}
+
+func (p *ProxyCompressor) putEncoder(zw proxyEncoder) {
+	zw.Reset(nil)
+	switch zw := zw.(type) {
+	case *brotli.Writer:
+		p.brotliPool.Put(zw)
+	case *gzip.Writer:
+		p.gzipPool.Put(zw)
+	}
+}
+
+const (
+	proxyCompressPending = iota // 已有状态码,等待足够的body再决定
+	proxyCompressOn
+	proxyCompressOff
+)
+
+type proxyCompressWriter struct {
+	http.ResponseWriter
+	compressor *ProxyCompressor
+	encoding   string // 为空时不压缩
+	status     int    // 0表示尚未WriteHeader
+	state      int
+	buf        []byte
+	zw         proxyEncoder
+}
+
+func (w *proxyCompressWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	h := w.Header()
+	addProxyVary(h, "Accept-Encoding")
+	switch {
+	case w.encoding == "", status < 200, status == http.StatusNoContent, status == http.StatusNotModified,
+		status == http.StatusPartialContent, !w.compressor.compressible(h):
+		w.passthrough()
+	default:
+		if cl := h.Get("Content-Length"); cl != "" {
+			if n, err := strconv.Atoi(cl); err == nil && n < w.compressor.config.MinSize {
+				w.passthrough()
+			} else {
+				w.start()
+			}
+		}
+		// 长度未知时等待body
+	}
+}
+
+// 添加Vary中没有的请求头,忽略大小写
+func addProxyVary(h http.Header, name string) {
+	for _, v := range h["Vary"] {
+		for _, n := range strings.Split(v, ",") {
+			if n = strings.TrimSpace(n); n == "*" || strings.EqualFold(n, name) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", name)
+}
+
+func (w *proxyCompressWriter) passthrough() {
+	w.state = proxyCompressOff
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+func (w *proxyCompressWriter) start() {
+	w.state = proxyCompressOn
+	h := w.Header()
+	h.Set("Content-Encoding", w.encoding)
+	h.Del("Content-Length")
+	h.Del("Accept-Ranges")
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag) // 压缩后不再是字节一致的表示
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	w.zw = w.compressor.getEncoder(w.encoding, w.ResponseWriter)
+}
+
+func (w *proxyCompressWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	switch w.state {
+	case proxyCompressOn:
+		return w.zw.Write(p)
+	case proxyCompressOff:
+		return w.ResponseWriter.Write(p)
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= w.compressor.config.MinSize {
+		w.start()
+		if err := w.drain(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// 写出等待判断时缓存的body
+func (w *proxyCompressWriter) drain() (err error) {
+	if len(w.buf) > 0 {
+		if w.state == proxyCompressOn {
+			_, err = w.zw.Write(w.buf)
+		} else {
+			_, err = w.ResponseWriter.Write(w.buf)
+		}
+		w.buf = nil
+	}
+	return
+}
+
+func (w *proxyCompressWriter) Flush() {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.state == proxyCompressPending && w.status != 0 {
+		// 流式响应不再等待MinSize
+		w.start()
+		w.drain()
+	}
+	if w.zw != nil {
+		w.zw.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// 升级协议(如websocket)时不压缩
+func (w *proxyCompressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hj.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+func (w *proxyCompressWriter) close() {
+	if w.state == proxyCompressPending && w.status != 0 {
+		// body不足MinSize
+		w.passthrough()
+		w.drain()
+	}
+	if w.zw != nil {
+		w.zw.Close()
+		w.compressor.putEncoder(w.zw)
+		w.zw = nil
+	}
+}
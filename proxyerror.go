@@ -0,0 +1,109 @@
+package kit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// 客户端在收到响应前断开,同nginx的499,只记录日志
+const PROXY_STATUS_CLIENT_CLOSED = 499
+
+// 处理代理错误,签名同httputil.ReverseProxy.ErrorHandler
+type ProxyErrorHandlerFunc func(w http.ResponseWriter, r *http.Request, err error)
+
+var (
+	proxyErrorHandlerMutex sync.RWMutex
+	proxyErrorHandlers     = make(map[string]ProxyErrorHandlerFunc)
+)
+
+/*
+注册自定义的代理错误处理,之后可以在配置proxyErrorHandler中按名称引用.
+名称在SetupHttp/ReloadHttp时解析,未注册时panic; 只有包初始化时读取的配置允许之后再注册
+*/
+func RegisterProxyErrorHandler(name string, handler ProxyErrorHandlerFunc) {
+	proxyErrorHandlerMutex.Lock()
+	proxyErrorHandlers[name] = handler
+	proxyErrorHandlerMutex.Unlock()
+}
+
+func getProxyErrorHandler(name string) ProxyErrorHandlerFunc {
+	proxyErrorHandlerMutex.RLock()
+	defer proxyErrorHandlerMutex.RUnlock()
+	return proxyErrorHandlers[name]
+}
+
+/*
+包初始化时读取的配置可能引用其他包在init中才注册的处理器,此时先记录警告,出错时再按名称查找,
+仍未注册时按none处理
+*/
+func lazyProxyErrorHandler(name string) func(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("http: proxy error handler %q not registered yet", name)
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		if handler := getProxyErrorHandler(name); handler != nil {
+			handler(w, r, err)
+			return
+		}
+		log.Printf("http: unregistered proxy error handler %q", name)
+		proxyGuardErrorHandler(nil)(w, r, err)
+	}
+}
+
+/*
+按错误类型返回代理响应的状态码:
+1. 客户端取消请求: 499
+2. 超时(含路由超时): 504
+3. 访问控制拒绝: 403
+4. 入站请求携带保留头: 400
+5. 没有可用上游: 503
+6. 其他: 502
+*/
+func ProxyErrorStatus(r *http.Request, err error) int {
+	if errors.Is(err, context.Canceled) || r.Context().Err() == context.Canceled {
+		return PROXY_STATUS_CLIENT_CLOSED
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	switch {
+	case errors.Is(err, ErrProxyForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, ErrProxyReverseHeader):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrProxyNoUpstream):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+// 记录错误细节并返回状态码,客户端已断开时返回0表示不必写响应
+func logProxyError(r *http.Request, err error) int {
+	status := ProxyErrorStatus(r, err)
+	log.Printf("http: proxy error: %d %s %s: %v", status, r.Method, r.URL, err)
+	if status == PROXY_STATUS_CLIENT_CLOSED {
+		return 0
+	}
+	return status
+}
+
+func proxyStatusErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	if status := logProxyError(r, err); status != 0 {
+		w.WriteHeader(status)
+	}
+}
+
+func proxyJsonErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	if status := logProxyError(r, err); status != 0 {
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(&HttpProblem{Status: status, Title: http.StatusText(status)})
+	}
+}
@@ -0,0 +1,126 @@
+package kit
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	ProxyTrusted_All  = "*"    // 信任所有客户端,追加到已有的转发头(默认,兼容旧版本)
+	ProxyTrusted_None = "none" // 不信任任何客户端,总是覆盖转发头
+)
+
+// 转发头的生成策略,由HttpConfig的proxyForwarded/proxyXForwarded/proxyTrustedCIDRs决定
+type proxyForwarding struct {
+	forwarded  bool
+	xforwarded bool
+	trustAll   bool
+	trusted    []*net.IPNet
+}
+
+func newProxyForwarding(c *HttpConfig) *proxyForwarding {
+	f := &proxyForwarding{
+		forwarded:  c.ProxyForwarded,
+		xforwarded: c.ProxyXForwarded,
+	}
+	var cidrs []string
+	for _, v := range c.ProxyTrustedCIDRs {
+		switch v {
+		case ProxyTrusted_All:
+			f.trustAll = true
+		case ProxyTrusted_None:
+		default:
+			cidrs = append(cidrs, v)
+		}
+	}
+	f.trusted = parseProxyCIDRs(cidrs)
+	return f
+}
+
+func (f *proxyForwarding) trusts(ip net.IP) bool {
+	return f.trustAll || (ip != nil && containsProxyIP(f.trusted, ip))
+}
+
+/*
+返回客户端地址,用于限流及按ip哈希: 从直连的地址开始,沿X-Forwarded-For从右向左,
+直到遇到不在proxyTrustedCIDRs中的地址. 只按明确配置的CIDR判断,信任所有客户端(*)时不使用
+X-Forwarded-For,否则客户端可以伪造地址
+*/
+func (f *proxyForwarding) clientIP(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	if peer := net.ParseIP(ip); peer == nil || !containsProxyIP(f.trusted, peer) {
+		return ip
+	}
+	var hops []string
+	for _, v := range req.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop.String()
+		if !containsProxyIP(f.trusted, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+/*
+在Director改写URL前调用,此时req.Host仍为入站Host:
+1. 客户端不受信任时删除入站的转发头,X-Forwarded-For随后由httputil.ReverseProxy重新生成
+2. 受信任时保留入站的X-Forwarded-Host/Proto,并将本跳追加到Forwarded
+*/
+func (f *proxyForwarding) apply(req *http.Request) {
+	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		clientIP = req.RemoteAddr
+	}
+	trusted := f.trusts(net.ParseIP(clientIP))
+	if !trusted {
+		req.Header.Del("X-Forwarded-For")
+		req.Header.Del("X-Forwarded-Host")
+		req.Header.Del("X-Forwarded-Proto")
+		req.Header.Del("Forwarded")
+	}
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	if f.xforwarded {
+		if req.Header.Get("X-Forwarded-Host") == "" {
+			req.Header.Set("X-Forwarded-Host", req.Host)
+		}
+		if req.Header.Get("X-Forwarded-Proto") == "" {
+			req.Header.Set("X-Forwarded-Proto", proto)
+		}
+	}
+	if f.forwarded {
+		node := clientIP
+		if ip := net.ParseIP(clientIP); ip != nil && ip.To4() == nil {
+			node = "[" + clientIP + "]"
+		}
+		elem := "for=" + quoteForwarded(node) + ";host=" + quoteForwarded(req.Host) + ";proto=" + proto
+		if prior := req.Header.Values("Forwarded"); len(prior) > 0 {
+			elem = strings.Join(prior, ", ") + ", " + elem
+		}
+		req.Header.Set("Forwarded", elem)
+	}
+}
+
+// RFC 7239: 非token字符(如IPv6的[]与端口的:)需要使用quoted-string
+func quoteForwarded(v string) string {
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+	return v
+}
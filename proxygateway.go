@@ -0,0 +1,430 @@
+package kit
+
+import (
+	"context"
+	"fmt"
+	"github.com/obase/conf"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const PROXY_CKEY = "proxy"
+
+/*
+网关配置,对应conf中的proxy节点:
+
+	proxy:
+	  reloadInterval: 10s
+	  upstreams:
+	    user:
+	      balance: roundrobin
+	      targets:
+	        - url: http://10.0.0.1:8080
+	          weight: 2
+	      healthCheck:
+	        path: /health
+	  routes:
+	    - host: api.example.com
+	      prefix: /user
+	      path: strip
+	      upstream: user
+	      timeout: 3s
+*/
+type ProxyConfig struct {
+	// ReloadInterval, if positive, makes LoadProxyGateway poll the conf package
+	// at this interval and rebuild the routes when the "proxy" section changes.
+	ReloadInterval time.Duration `json:"reloadInterval" yaml:"reloadInterval"`
+
+	// Upstreams are named pools referenced by ProxyRouteConfig.Upstream.
+	Upstreams map[string]*ProxyUpstreamConfig `json:"upstreams" yaml:"upstreams"`
+
+	// Routes are matched in order, the first match handles the request.
+	// Requests matching no route get 404.
+	Routes []*ProxyRouteConfig `json:"routes" yaml:"routes"`
+}
+
+type ProxyUpstreamConfig struct {
+	// Balance is one of roundrobin, weighted, leastconn, hash. Default roundrobin.
+	Balance string `json:"balance" yaml:"balance"`
+
+	// HashKey is ip, header:<name> or cookie:<name>, used by hash balance.
+	HashKey string `json:"hashKey" yaml:"hashKey"`
+
+	Targets []*ProxyTargetConfig `json:"targets" yaml:"targets"`
+
+	// HealthCheck, if set, enables active health checks of the targets.
+	HealthCheck *ProxyHealthCheck `json:"healthCheck" yaml:"healthCheck"`
+
+	// Retry, if set, retries failed idempotent requests on another target.
+	Retry *ProxyRetry `json:"retry" yaml:"retry"`
+}
+
+type ProxyTargetConfig struct {
+	Url    string `json:"url" yaml:"url"`
+	Weight int    `json:"weight" yaml:"weight"`
+}
+
+type ProxyRouteConfig struct {
+	Name string `json:"name" yaml:"name"`
+
+	// Host matches the request host without port, case-insensitive.
+	// "*.example.com" matches any subdomain. Empty matches all.
+	Host string `json:"host" yaml:"host"`
+
+	// Prefix matches the beginning of the request path on a segment
+	// boundary: /api matches /api and /api/users but not /apiary.
+	Prefix string `json:"prefix" yaml:"prefix"`
+
+	// Regex matches the request path. Also used by path regex.
+	Regex string `json:"regex" yaml:"regex"`
+
+	// Methods, if not empty, restricts the route to these methods.
+	Methods []string `json:"methods" yaml:"methods"`
+
+	// Headers must all be present on the request. A value of "" or "*"
+	// only requires the header to exist, otherwise it must be equal.
+	Headers map[string]string `json:"headers" yaml:"headers"`
+
+	// Upstream names a pool in ProxyConfig.Upstreams. Either Upstream or Url is required.
+	Upstream string `json:"upstream" yaml:"upstream"`
+
+	// Url is a single target used when Upstream is empty.
+	Url string `json:"url" yaml:"url"`
+
+	// Path is how the request path is rewritten: replace, join, strip, regex.
+	// Default join. strip removes Prefix, regex replaces Regex with Rewrite.
+	Path string `json:"path" yaml:"path"`
+
+	Rewrite string `json:"rewrite" yaml:"rewrite"`
+
+	// HostHeader is the outbound Host: inbound, upstream or a fixed host. Default inbound.
+	HostHeader string `json:"hostHeader" yaml:"hostHeader"`
+
+	// Timeout, if positive, limits the whole proxied request.
+	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+
+	RequestHeaders  *ProxyHeaderRules `json:"requestHeaders" yaml:"requestHeaders"`
+	ResponseHeaders *ProxyHeaderRules `json:"responseHeaders" yaml:"responseHeaders"`
+
+	// RateLimit, if set, limits the requests of this route. Each route has its
+	// own limiter, key route shares one quota among all clients of the route.
+	RateLimit *ProxyRateLimit `json:"rateLimit" yaml:"rateLimit"`
+
+	// Cache, if set, caches cacheable GET responses of this route in memory.
+	Cache *ProxyCacheConfig `json:"cache" yaml:"cache"`
+
+	// Compress, if set, compresses the responses of this route. Cached
+	// responses are stored uncompressed and compressed per client.
+	Compress *ProxyCompressConfig `json:"compress" yaml:"compress"`
+}
+
+type proxyRoute struct {
+	name    string
+	host    string // 小写, ".example.com"表示子域名
+	prefix  string
+	regex   *regexp.Regexp
+	methods map[string]bool
+	headers map[string]string
+	timeout time.Duration
+	handler http.Handler
+}
+
+func (rt *proxyRoute) match(r *http.Request) bool {
+	if rt.host != "" {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(host)
+		if host != rt.host && (rt.host[0] != '.' || !strings.HasSuffix(host, rt.host)) {
+			return false
+		}
+	}
+	if rt.prefix != "" && !hasProxyPathPrefix(r.URL.Path, rt.prefix) {
+		return false
+	}
+	if rt.regex != nil && !rt.regex.MatchString(r.URL.Path) {
+		return false
+	}
+	if len(rt.methods) > 0 && !rt.methods[r.Method] {
+		return false
+	}
+	for k, v := range rt.headers {
+		if vs, ok := r.Header[k]; !ok || (v != "" && v != "*" && (len(vs) == 0 || vs[0] != v)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (rt *proxyRoute) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if rt.timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), rt.timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	rt.handler.ServeHTTP(w, r)
+}
+
+// 一次配置生成的路由表及其上游
+type proxyGatewayTable struct {
+	routes []*proxyRoute
+	stops  []func()
+}
+
+func (t *proxyGatewayTable) close() {
+	for _, stop := range t.stops {
+		stop()
+	}
+}
+
+// 配置非法时panic,已启动的健康检查会先停止
+func newProxyGatewayTable(c *ProxyConfig) *proxyGatewayTable {
+	t := new(proxyGatewayTable)
+	defer func() {
+		if perr := recover(); perr != nil {
+			t.close()
+			panic(perr)
+		}
+	}()
+	pools := make(map[string]*ProxyPool)
+	for name, uc := range c.Upstreams {
+		if uc == nil {
+			continue
+		}
+		pool := NewProxyPool(uc.Balance, uc.HashKey)
+		for _, tc := range uc.Targets {
+			if err := pool.Add(tc.Url, tc.Weight); err != nil {
+				panic("invalid proxy upstream " + name + ": " + err.Error())
+			}
+		}
+		if uc.Retry != nil {
+			pool.Retry(*uc.Retry)
+		}
+		if uc.HealthCheck != nil {
+			t.stops = append(t.stops, pool.HealthCheck(*uc.HealthCheck))
+		}
+		pools[name] = pool
+	}
+	for i, rc := range c.Routes {
+		rt, err := newProxyRoute(rc, pools)
+		if err != nil {
+			panic(fmt.Sprintf("invalid proxy route %d %s: %v", i, rc.Name, err))
+		}
+		t.routes = append(t.routes, rt)
+	}
+	return t
+}
+
+func newProxyRoute(rc *ProxyRouteConfig, pools map[string]*ProxyPool) (rt *proxyRoute, err error) {
+	defer func() {
+		if perr := recover(); perr != nil {
+			rt, err = nil, fmt.Errorf("%v", perr)
+		}
+	}()
+	rt = &proxyRoute{
+		name:    rc.Name,
+		host:    strings.ToLower(rc.Host),
+		prefix:  rc.Prefix,
+		timeout: rc.Timeout,
+	}
+	if strings.HasPrefix(rt.host, "*.") {
+		rt.host = rt.host[1:]
+	}
+	if rc.Regex != "" {
+		if rt.regex, err = regexp.Compile(rc.Regex); err != nil {
+			return nil, err
+		}
+	}
+	if len(rc.Methods) > 0 {
+		rt.methods = make(map[string]bool)
+		for _, m := range rc.Methods {
+			rt.methods[strings.ToUpper(m)] = true
+		}
+	}
+	if len(rc.Headers) > 0 {
+		rt.headers = make(map[string]string)
+		for k, v := range rc.Headers {
+			rt.headers[http.CanonicalHeaderKey(k)] = v
+		}
+	}
+
+	var opts []ProxyOption
+	switch rc.Path {
+	case "", ProxyPath_Join:
+		opts = append(opts, WithProxyPathJoin())
+	case ProxyPath_Replace:
+		opts = append(opts, WithProxyPathReplace())
+	case ProxyPath_Strip:
+		opts = append(opts, WithProxyStripPrefix(rc.Prefix))
+	case ProxyPath_Regex:
+		if rt.regex == nil {
+			return nil, fmt.Errorf("path regex requires regex")
+		}
+		opts = append(opts, func(o *proxyOptions) {
+			o.pathMode, o.pathRegex, o.pathRepl = ProxyPath_Regex, rt.regex, rc.Rewrite
+		})
+	default:
+		return nil, fmt.Errorf("invalid path mode %q", rc.Path)
+	}
+	if rc.HostHeader != "" {
+		opts = append(opts, WithProxyHost(rc.HostHeader))
+	}
+	if rc.RequestHeaders != nil {
+		opts = append(opts, WithProxyRequestHeaders(*rc.RequestHeaders))
+	}
+	if rc.ResponseHeaders != nil {
+		opts = append(opts, WithProxyResponseHeaders(*rc.ResponseHeaders))
+	}
+	o := newProxyOptions(opts...)
+
+	switch {
+	case rc.Upstream != "":
+		pool, ok := pools[rc.Upstream]
+		if !ok {
+			return nil, fmt.Errorf("unknown upstream %q", rc.Upstream)
+		}
+		rt.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pool.ServeHTTP(w, withProxyOptions(r, o))
+		})
+	case rc.Url != "":
+		target, err := url.Parse(rc.Url)
+		if err != nil {
+			return nil, err
+		}
+		rt.handler = newProxyHandler(o, target)
+	default:
+		return nil, fmt.Errorf("upstream or url required")
+	}
+	if rc.Cache != nil {
+		rt.handler = NewProxyCache(*rc.Cache).Handler(rt.handler)
+	}
+	if rc.Compress != nil {
+		rt.handler = NewProxyCompressor(*rc.Compress).Handler(rt.handler)
+	}
+	if rc.RateLimit != nil {
+		rt.handler = NewProxyRateLimiter(*rc.RateLimit).Handler(rt.handler)
+	}
+	return rt, nil
+}
+
+/*
+按ProxyConfig将请求路由到各个上游的http.Handler,可在运行期整体替换路由表.
+替换时正在处理的请求仍使用旧的路由表完成
+*/
+type ProxyGateway struct {
+	mutex   sync.Mutex
+	current atomic.Value // *proxyGatewayTable
+}
+
+// 配置非法时panic
+func NewProxyGateway(c *ProxyConfig) *ProxyGateway {
+	g := new(ProxyGateway)
+	g.Setup(c)
+	return g
+}
+
+// 按conf中的proxy节点创建网关,配置了reloadInterval时自动重载. 配置非法时panic
+func LoadProxyGateway() *ProxyGateway {
+	c, _, err := loadProxyConfig()
+	if err != nil {
+		panic("invalid proxy config: " + err.Error())
+	}
+	g := NewProxyGateway(c)
+	if c != nil && c.ReloadInterval > 0 {
+		g.Watch(c.ReloadInterval)
+	}
+	return g
+}
+
+func loadProxyConfig() (c *ProxyConfig, raw interface{}, err error) {
+	if cnf, ok := conf.Get(PROXY_CKEY); ok {
+		raw = cnf
+		err = conf.Convert(cnf, &c)
+	}
+	return
+}
+
+// 替换路由表,配置非法时panic并保留原路由表
+func (g *ProxyGateway) Setup(c *ProxyConfig) {
+	if c == nil {
+		c = new(ProxyConfig)
+	}
+	t := newProxyGatewayTable(c)
+	g.mutex.Lock()
+	old, _ := g.current.Load().(*proxyGatewayTable)
+	g.current.Store(t)
+	g.mutex.Unlock()
+	if old != nil {
+		old.close()
+	}
+}
+
+// 按conf中当前的proxy节点重建路由表,配置非法时返回错误并保留原路由表
+func (g *ProxyGateway) Reload() error {
+	c, _, err := loadProxyConfig()
+	if err != nil {
+		return fmt.Errorf("reload proxy failed: %v", err)
+	}
+	return g.reload(c)
+}
+
+func (g *ProxyGateway) reload(c *ProxyConfig) (err error) {
+	defer func() {
+		if perr := recover(); perr != nil {
+			err = fmt.Errorf("reload proxy failed: %v", perr)
+		}
+	}()
+	g.Setup(c)
+	return nil
+}
+
+// 定期检查conf中的proxy节点,变化时重建路由表,返回停止检查的函数
+func (g *ProxyGateway) Watch(interval time.Duration) (stop func()) {
+	_, last, _ := loadProxyConfig()
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				c, raw, err := loadProxyConfig()
+				if reflect.DeepEqual(raw, last) {
+					continue
+				}
+				last = raw
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "watch proxy: %v\n", err)
+				} else if err = g.reload(c); err != nil {
+					fmt.Fprintf(os.Stderr, "watch proxy: %v\n", err)
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+func (g *ProxyGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t := g.current.Load().(*proxyGatewayTable)
+	for _, rt := range t.routes {
+		if rt.match(r) {
+			rt.ServeHTTP(w, r)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
@@ -0,0 +1,181 @@
+package kit
+
+import (
+	"fmt"
+	"github.com/obase/conf"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProxyGateway(t *testing.T) {
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				time.Sleep(200 * time.Millisecond)
+			}
+			w.Header().Set("X-Internal", "1")
+			fmt.Fprintf(w, "%s %s %s %s", name, r.Host, r.URL.Path, r.Header.Get("X-Route"))
+		}))
+	}
+	a, b := backend("a"), backend("b")
+	defer a.Close()
+	defer b.Close()
+
+	g := NewProxyGateway(&ProxyConfig{
+		Upstreams: map[string]*ProxyUpstreamConfig{
+			"a": {Targets: []*ProxyTargetConfig{{Url: a.URL}}},
+		},
+		Routes: []*ProxyRouteConfig{
+			{Host: "*.example.com", Url: b.URL, HostHeader: "b.internal"},
+			{Prefix: "/api", Methods: []string{"post"}, Headers: map[string]string{"X-Env": "beta"}, Url: b.URL},
+			{Prefix: "/api", Path: ProxyPath_Strip, Upstream: "a",
+				RequestHeaders:  &ProxyHeaderRules{Set: map[string]string{"X-Route": "api"}},
+				ResponseHeaders: &ProxyHeaderRules{Remove: []string{"X-Internal"}},
+			},
+			{Regex: `^/v(\d+)/`, Path: ProxyPath_Regex, Rewrite: "/version$1/", Upstream: "a"},
+			{Prefix: "/slow", Url: b.URL, Timeout: 50 * time.Millisecond},
+			{Prefix: "/cached", Path: ProxyPath_Strip, Url: b.URL, Timeout: 50 * time.Millisecond, Cache: &ProxyCacheConfig{}},
+			{Prefix: "/limited", Url: b.URL, RateLimit: &ProxyRateLimit{Rate: 1, Period: time.Hour}},
+		},
+	})
+
+	serve := func(method, target string, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve(http.MethodGet, "http://www.example.com/x", nil); w.Body.String() != "b b.internal /x " {
+		t.Fatalf("host route: %q", w.Body.String())
+	}
+	if w := serve(http.MethodPost, "/api/users", map[string]string{"X-Env": "beta"}); w.Body.String() != "b example.com /api/users " {
+		t.Fatalf("method/header route: %q", w.Body.String())
+	}
+	w := serve(http.MethodPost, "/api/users", nil)
+	if w.Body.String() != "a example.com /users api" || w.Header().Get("X-Internal") != "" {
+		t.Fatalf("prefix route: %q %v", w.Body.String(), w.Header())
+	}
+	if w := serve(http.MethodGet, "/v2/users", nil); w.Body.String() != "a example.com /version2/users " {
+		t.Fatalf("regex route: %q", w.Body.String())
+	}
+	// 路由超时的状态码取决于proxyErrorHandler: body/none为502,status/json为504
+	if w := serve(http.MethodGet, "/slow", nil); w.Code != http.StatusBadGateway {
+		t.Fatalf("expected timeout to fail, got %d", w.Code)
+	}
+	SetupHttp(&HttpConfig{ProxyErrorHandler: ProxyErrorHandler_Status})
+	defer SetupHttp(nil)
+	if w := serve(http.MethodGet, "/slow", nil); w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504 on route timeout, got %d", w.Code)
+	}
+	// 等待合并请求的超时同样返回504
+	codes := make(chan int, 3)
+	for i := 0; i < cap(codes); i++ {
+		go func() {
+			codes <- serve(http.MethodGet, "/cached/slow", nil).Code
+		}()
+	}
+	for i := 0; i < cap(codes); i++ {
+		if code := <-codes; code != http.StatusGatewayTimeout {
+			t.Fatalf("expected 504 for coalesced requests on route timeout, got %d", code)
+		}
+	}
+	if w := serve(http.MethodGet, "/limited", nil); w.Code != http.StatusOK {
+		t.Fatalf("first request of limited route: %d", w.Code)
+	}
+	if w := serve(http.MethodGet, "/limited", nil); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected route rate limit, got %d", w.Code)
+	}
+	if w := serve(http.MethodGet, "/none", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 without route, got %d", w.Code)
+	}
+}
+
+func TestProxyGatewayReload(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	conf.Setup(map[string]interface{}{PROXY_CKEY: map[string]interface{}{
+		"routes": []interface{}{map[string]interface{}{"prefix": "/a", "url": srv.URL}},
+	}})
+	defer conf.Setup(map[string]interface{}{PROXY_CKEY: nil})
+	g := LoadProxyGateway()
+
+	serve := func(path string) int {
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+	if serve("/a") != http.StatusOK || serve("/b") != http.StatusNotFound {
+		t.Fatal("unexpected routes before reload")
+	}
+
+	conf.Setup(map[string]interface{}{PROXY_CKEY: map[string]interface{}{
+		"routes": []interface{}{map[string]interface{}{"prefix": "/b", "url": srv.URL, "timeout": "1s"}},
+	}})
+	if err := g.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if serve("/a") != http.StatusNotFound || serve("/b") != http.StatusOK {
+		t.Fatal("unexpected routes after reload")
+	}
+
+	conf.Setup(map[string]interface{}{PROXY_CKEY: map[string]interface{}{
+		"routes": []interface{}{map[string]interface{}{"prefix": "/c", "upstream": "unknown"}},
+	}})
+	if err := g.Reload(); err == nil {
+		t.Fatal("expected error for invalid config")
+	}
+	if serve("/b") != http.StatusOK {
+		t.Fatal("invalid config should keep the previous routes")
+	}
+
+	conf.Setup(map[string]interface{}{PROXY_CKEY: map[string]interface{}{
+		"routes": map[string]interface{}{"prefix": "/c"},
+	}})
+	if err := g.Reload(); err == nil {
+		t.Fatal("expected error for malformed config")
+	}
+	if serve("/b") != http.StatusOK || serve("/bb") != http.StatusNotFound {
+		t.Fatal("malformed config should keep the previous routes")
+	}
+}
+
+func TestProxyGatewayInvalidUpstream(t *testing.T) {
+	var probes int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&probes, 1)
+	}))
+	defer srv.Close()
+
+	// 先启动的健康检查在之后的上游配置非法时应停止
+	for i := 0; i < 5; i++ {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("expected panic for invalid balance")
+				}
+			}()
+			NewProxyGateway(&ProxyConfig{
+				Upstreams: map[string]*ProxyUpstreamConfig{
+					"a": {Targets: []*ProxyTargetConfig{{Url: srv.URL}}, HealthCheck: &ProxyHealthCheck{Interval: 10 * time.Millisecond}},
+					"b": {Targets: []*ProxyTargetConfig{{Url: srv.URL}}, Balance: "bogus"},
+				},
+			})
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	n := atomic.LoadInt32(&probes)
+	time.Sleep(100 * time.Millisecond)
+	if m := atomic.LoadInt32(&probes); m != n {
+		t.Fatalf("health checks of a failed config keep running: %d -> %d probes", n, m)
+	}
+}
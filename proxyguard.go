@@ -0,0 +1,213 @@
+package kit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var ErrProxyForbidden = errors.New("proxy forbidden")
+
+// ProxyDenyPrivate拒绝的地址段: 环回,私有,运营商NAT,链路本地,未指定及组播
+var proxyPrivateNets = parseProxyCIDRs([]string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"224.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+})
+
+/*
+代理目标的访问控制:
+1. scheme必须在allowSchemes中
+2. 配置了allowHosts/allowCIDRs时,目标host需匹配allowHosts,或DNS解析后的地址在allowCIDRs内
+3. DNS解析后的地址在denyCIDRs内(含denyPrivate)时一律拒绝,即使host已匹配allowHosts
+*/
+type proxyGuard struct {
+	schemes   map[string]bool
+	hosts     []string // 小写, ".example.com"表示子域名
+	allowNets []*net.IPNet
+	denyNets  []*net.IPNet
+}
+
+type proxyGuardKey struct{}
+
+func newProxyGuard(c *HttpConfig) *proxyGuard {
+	g := &proxyGuard{
+		schemes:   make(map[string]bool),
+		allowNets: parseProxyCIDRs(c.ProxyAllowCIDRs),
+		denyNets:  parseProxyCIDRs(c.ProxyDenyCIDRs),
+	}
+	for _, s := range c.ProxyAllowSchemes {
+		g.schemes[strings.ToLower(s)] = true
+	}
+	for _, h := range c.ProxyAllowHosts {
+		h = strings.ToLower(h)
+		if strings.HasPrefix(h, "*.") {
+			h = h[1:]
+		}
+		g.hosts = append(g.hosts, h)
+	}
+	if c.ProxyDenyPrivate {
+		g.denyNets = append(g.denyNets, proxyPrivateNets...)
+	}
+	return g
+}
+
+func parseProxyCIDRs(vs []string) (rets []*net.IPNet) {
+	for _, v := range vs {
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(v)
+		if err != nil {
+			panic("invalid proxy cidr: " + v)
+		}
+		rets = append(rets, ipnet)
+	}
+	return
+}
+
+func containsProxyIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 是否需要在拨号时检查解析后的地址
+func (g *proxyGuard) dialing() bool {
+	return len(g.allowNets) > 0 || len(g.denyNets) > 0
+}
+
+func (g *proxyGuard) enabled() bool {
+	return len(g.schemes) > 0 || len(g.hosts) > 0 || g.dialing()
+}
+
+func (g *proxyGuard) matchHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, h := range g.hosts {
+		if h == host || (h[0] == '.' && strings.HasSuffix(host, h)) {
+			return true
+		}
+	}
+	return false
+}
+
+// 检查scheme与host,返回host是否已被allowHosts放行
+func (g *proxyGuard) checkURL(u *url.URL) (allowed bool, err error) {
+	if len(g.schemes) > 0 && !g.schemes[strings.ToLower(u.Scheme)] {
+		return false, fmt.Errorf("%w: scheme %q", ErrProxyForbidden, u.Scheme)
+	}
+	if len(g.hosts) == 0 && len(g.allowNets) == 0 {
+		return true, nil
+	}
+	host := u.Hostname()
+	if g.matchHost(host) {
+		return true, nil
+	}
+	if ip := net.ParseIP(host); ip != nil && containsProxyIP(g.allowNets, ip) {
+		return true, nil
+	}
+	if len(g.allowNets) == 0 || net.ParseIP(host) != nil {
+		return false, fmt.Errorf("%w: host %q", ErrProxyForbidden, host)
+	}
+	// 由拨号时按解析后的地址判断
+	return false, nil
+}
+
+func (g *proxyGuard) checkIP(ip net.IP, allowed bool) error {
+	if containsProxyIP(g.denyNets, ip) {
+		return fmt.Errorf("%w: address %s", ErrProxyForbidden, ip)
+	}
+	if !allowed && !containsProxyIP(g.allowNets, ip) {
+		return fmt.Errorf("%w: address %s", ErrProxyForbidden, ip)
+	}
+	return nil
+}
+
+// 自行解析DNS并只拨号到检查通过的地址,避免检查与拨号之间的DNS重绑定
+func (g *proxyGuard) dial(dial httpDialFunc) httpDialFunc {
+	return func(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		allowed, _ := ctx.Value(proxyGuardKey{}).(bool)
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var lastErr error
+		for _, ip := range ips {
+			if err = g.checkIP(ip.IP, allowed); err == nil {
+				if conn, err = dial(ctx, network, net.JoinHostPort(ip.IP.String(), port)); err == nil {
+					return conn, nil
+				}
+			}
+			if lastErr == nil || !errors.Is(err, ErrProxyForbidden) {
+				lastErr = err // 优先返回拨号错误
+			}
+		}
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no address for %q", host)
+		}
+		return nil, lastErr
+	}
+}
+
+// 代理出站前检查scheme与host,并将检查结果传递给拨号
+type proxyGuardTransport struct {
+	guard *proxyGuard
+	http.RoundTripper
+}
+
+func (t proxyGuardTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	allowed, err := t.guard.checkURL(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(context.WithValue(req.Context(), proxyGuardKey{}, allowed))
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// 被拒绝的目标返回403,其余交给next处理
+func proxyGuardErrorHandler(next func(w http.ResponseWriter, r *http.Request, err error)) func(w http.ResponseWriter, r *http.Request, err error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		if errors.Is(err, ErrProxyForbidden) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, ErrProxyReverseHeader) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if next != nil {
+			next(w, r, err)
+			return
+		}
+		// 同httputil.ReverseProxy的默认行为
+		log.Printf("http: proxy error: %v", err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+}
@@ -0,0 +1,189 @@
+package kit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	PROXY_HEALTH_PATH     = "/"
+	PROXY_HEALTH_INTERVAL = 10 * time.Second
+	PROXY_HEALTH_TIMEOUT  = 2 * time.Second
+	PROXY_HEALTH_RISE     = 2
+	PROXY_HEALTH_FALL     = 3
+)
+
+/*
+上游的主动健康检查:
+1. 每隔Interval对每个上游GET Path,状态码等于Status(为0时2xx/3xx均可)视为成功
+2. 连续Fall次失败后移出轮转,之后连续Rise次成功再加回
+*/
+type ProxyHealthCheck struct {
+	Path     string        `json:"path" yaml:"path"`         // 相对上游地址解析,默认"/"
+	Status   int           `json:"status" yaml:"status"`     // 期望的状态码
+	Interval time.Duration `json:"interval" yaml:"interval"` // 默认10s
+	Timeout  time.Duration `json:"timeout" yaml:"timeout"`   // 默认2s
+	Rise     int           `json:"rise" yaml:"rise"`         // 默认2
+	Fall     int           `json:"fall" yaml:"fall"`         // 默认3
+}
+
+func (hc ProxyHealthCheck) fill() ProxyHealthCheck {
+	if hc.Path == "" {
+		hc.Path = PROXY_HEALTH_PATH
+	}
+	if hc.Interval <= 0 {
+		hc.Interval = PROXY_HEALTH_INTERVAL
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = PROXY_HEALTH_TIMEOUT
+	}
+	if hc.Rise <= 0 {
+		hc.Rise = PROXY_HEALTH_RISE
+	}
+	if hc.Fall <= 0 {
+		hc.Fall = PROXY_HEALTH_FALL
+	}
+	return hc
+}
+
+// 上游的健康状态,新加入的上游视为健康
+type ProxyUpstreamStatus struct {
+	Url       string    `json:"url"`
+	Weight    int       `json:"weight"`
+	Healthy   bool      `json:"healthy"`
+	Active    int64     `json:"active"`
+	LastCheck time.Time `json:"lastCheck,omitempty"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// 健康检查的状态,除healthy外由proxyHealth.mutex保护
+type proxyHealth struct {
+	mutex     sync.Mutex
+	rises     int
+	falls     int
+	lastCheck time.Time
+	lastError string
+}
+
+func (u *proxyUpstream) isHealthy() bool {
+	return atomic.LoadInt32(&u.unhealthy) == 0
+}
+
+func (u *proxyUpstream) report(hc *ProxyHealthCheck, err error) {
+	h := &u.health
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.lastCheck = time.Now()
+	if err != nil {
+		h.lastError = err.Error()
+		h.rises = 0
+		if h.falls++; h.falls >= hc.Fall {
+			atomic.StoreInt32(&u.unhealthy, 1)
+		}
+		return
+	}
+	h.lastError = ""
+	h.falls = 0
+	if h.rises++; h.rises >= hc.Rise {
+		atomic.StoreInt32(&u.unhealthy, 0)
+	}
+}
+
+/*
+按hc定期检查所有上游,返回停止检查的函数.
+检查请求与代理流量使用相同的Transport,受代理访问控制约束
+*/
+func (p *ProxyPool) HealthCheck(hc ProxyHealthCheck) (stop func()) {
+	hc = hc.fill()
+	ref, err := url.Parse(hc.Path)
+	if err != nil {
+		panic("invalid proxy health path: " + hc.Path)
+	}
+	client := &http.Client{
+		Transport: httpDynamicProxyTransport{},
+		Timeout:   hc.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(hc.Interval)
+		defer ticker.Stop()
+		for {
+			p.mutex.RLock()
+			ups := p.upstreams
+			p.mutex.RUnlock()
+			var wg sync.WaitGroup
+			for _, u := range ups {
+				wg.Add(1)
+				go func(u *proxyUpstream) {
+					defer wg.Done()
+					u.report(&hc, probeProxyUpstream(client, u.target.ResolveReference(ref).String(), hc.Status))
+				}(u)
+			}
+			wg.Wait()
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+func probeProxyUpstream(client *http.Client, rurl string, status int) error {
+	rsp, err := client.Get(rurl)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, rsp.Body)
+	rsp.Body.Close()
+	if status == 0 {
+		if rsp.StatusCode >= 200 && rsp.StatusCode < 400 {
+			return nil
+		}
+	} else if rsp.StatusCode == status {
+		return nil
+	}
+	return fmt.Errorf("unexpected status %d", rsp.StatusCode)
+}
+
+// 返回所有上游的健康状态
+func (p *ProxyPool) Status() []ProxyUpstreamStatus {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	rets := make([]ProxyUpstreamStatus, len(p.upstreams))
+	for i, u := range p.upstreams {
+		u.health.mutex.Lock()
+		rets[i] = ProxyUpstreamStatus{
+			Url:       u.url,
+			Weight:    u.weight,
+			Healthy:   u.isHealthy(),
+			Active:    atomic.LoadInt64(&u.active),
+			LastCheck: u.health.lastCheck,
+			LastError: u.health.lastError,
+		}
+		u.health.mutex.Unlock()
+	}
+	return rets
+}
+
+// 以json输出Status()
+func (p *ProxyPool) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p.Status())
+	})
+}
@@ -0,0 +1,307 @@
+package kit
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	PROXY_MIRROR_QUEUE_SIZE = 128
+	PROXY_MIRROR_WORKERS    = 4
+	PROXY_MIRROR_BODY_LIMIT = 64 * 1024
+	PROXY_MIRROR_TIMEOUT    = 5 * time.Second
+)
+
+/*
+将部分代理请求异步复制到影子上游,丢弃其响应:
+1. 按Percent(0~100)抽样,未设置时为100,为0时暂停复制
+2. 请求body在转发主上游的同时复制,超过BodyLimit的请求不复制
+3. 由Workers个goroutine从长度为QueueSize的队列发送,队列满时丢弃,不影响主路径
+*/
+type ProxyMirrorConfig struct {
+	Url       string        `json:"url" yaml:"url"`
+	Percent   *float64      `json:"percent" yaml:"percent"` // nil表示100,区别于0
+	QueueSize int           `json:"queueSize" yaml:"queueSize"`
+	Workers   int           `json:"workers" yaml:"workers"`
+	BodyLimit int64         `json:"bodyLimit" yaml:"bodyLimit"`
+	Timeout   time.Duration `json:"timeout" yaml:"timeout"`
+}
+
+func (c ProxyMirrorConfig) fill() ProxyMirrorConfig {
+	if c.Percent == nil {
+		percent := 100.0
+		c.Percent = &percent
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = PROXY_MIRROR_QUEUE_SIZE
+	}
+	if c.Workers <= 0 {
+		c.Workers = PROXY_MIRROR_WORKERS
+	}
+	if c.BodyLimit <= 0 {
+		c.BodyLimit = PROXY_MIRROR_BODY_LIMIT
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = PROXY_MIRROR_TIMEOUT
+	}
+	return c
+}
+
+// 影子请求的统计
+type ProxyMirrorStats struct {
+	Sampled int64         `json:"sampled"` // 抽中的请求数
+	Skipped int64         `json:"skipped"` // body超过限制或未读完而未复制
+	Dropped int64         `json:"dropped"` // 队列满而丢弃
+	Sent    int64         `json:"sent"`    // 已发送并收到响应
+	Errors  int64         `json:"errors"`  // 发送失败,如连接失败或超时
+	Status  map[int]int64 `json:"status"`  // 按状态码统计的响应数
+}
+
+type ProxyMirror struct {
+	sampled int64
+	skipped int64
+	dropped int64
+	sent    int64
+	errors  int64
+
+	config ProxyMirrorConfig
+	target *url.URL
+	queue  chan *http.Request
+	done   chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+	mutex  sync.Mutex
+	status map[int]int64
+}
+
+// 创建并启动影子请求的发送goroutine,Url或Percent非法时panic
+func NewProxyMirror(c ProxyMirrorConfig) *ProxyMirror {
+	c = c.fill()
+	if *c.Percent < 0 || *c.Percent > 100 {
+		panic("invalid proxy mirror percent: " + strconv.FormatFloat(*c.Percent, 'g', -1, 64))
+	}
+	target, err := url.Parse(c.Url)
+	if err != nil || target.Host == "" {
+		panic("invalid proxy mirror url: " + c.Url)
+	}
+	m := &ProxyMirror{
+		config: c,
+		target: target,
+		queue:  make(chan *http.Request, c.QueueSize),
+		done:   make(chan struct{}),
+		status: make(map[int]int64),
+	}
+	for i := 0; i < c.Workers; i++ {
+		m.wg.Add(1)
+		go m.work()
+	}
+	return m
+}
+
+// 将请求复制到m指向的影子上游,路径及Host按其他代理选项改写
+func WithProxyMirror(m *ProxyMirror) ProxyOption {
+	return func(o *proxyOptions) {
+		o.mirror = m
+	}
+}
+
+// 停止发送,队列中未发送的请求被丢弃
+func (m *ProxyMirror) Close() {
+	m.once.Do(func() {
+		close(m.done)
+	})
+	m.wg.Wait()
+}
+
+func (m *ProxyMirror) Stats() ProxyMirrorStats {
+	st := ProxyMirrorStats{
+		Sampled: atomic.LoadInt64(&m.sampled),
+		Skipped: atomic.LoadInt64(&m.skipped),
+		Dropped: atomic.LoadInt64(&m.dropped),
+		Sent:    atomic.LoadInt64(&m.sent),
+		Errors:  atomic.LoadInt64(&m.errors),
+		Status:  make(map[int]int64),
+	}
+	m.mutex.Lock()
+	for k, v := range m.status {
+		st.Status[k] = v
+	}
+	m.mutex.Unlock()
+	return st
+}
+
+func (m *ProxyMirror) work() {
+	defer m.wg.Done()
+	for {
+		select {
+		case <-m.done:
+			return
+		case req := <-m.queue:
+			m.send(req)
+		}
+	}
+}
+
+func (m *ProxyMirror) send(req *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.config.Timeout)
+	defer cancel()
+	rsp, err := httpDynamicProxyTransport{}.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		atomic.AddInt64(&m.errors, 1)
+		return
+	}
+	io.Copy(ioutil.Discard, rsp.Body)
+	rsp.Body.Close()
+	m.mutex.Lock()
+	m.status[rsp.StatusCode]++
+	m.mutex.Unlock()
+	atomic.AddInt64(&m.sent, 1) // 最后计数,Sent变化时Status已更新
+}
+
+func (m *ProxyMirror) enqueue(req *http.Request) {
+	select {
+	case <-m.done:
+		atomic.AddInt64(&m.dropped, 1)
+	case m.queue <- req:
+	default:
+		atomic.AddInt64(&m.dropped, 1)
+	}
+}
+
+/*
+按抽样决定是否复制出站请求out,inbound与host为改写前的URL与Host.
+有body时边转发边复制,读完后才放入队列
+*/
+func (m *ProxyMirror) capture(o *proxyOptions, out *http.Request, inbound *url.URL, host string) {
+	if percent := *m.config.Percent; percent < 100 && rand.Float64()*100 >= percent {
+		return
+	}
+	atomic.AddInt64(&m.sampled, 1)
+	if out.ContentLength > m.config.BodyLimit {
+		atomic.AddInt64(&m.skipped, 1)
+		return
+	}
+	mreq := out.Clone(context.Background())
+	mreq.URL = inbound
+	mreq.Host = host
+	o.retarget(mreq, m.target)
+	mreq.Body, mreq.GetBody = nil, nil
+	// Director之后ReverseProxy才处理逐跳头及X-Forwarded-For,影子请求需同样处理
+	removeProxyHopHeaders(mreq.Header)
+	setProxyForwardedFor(mreq)
+	if out.Body == nil || out.Body == http.NoBody {
+		m.enqueue(mreq)
+		return
+	}
+	out.Body = &proxyMirrorBody{ReadCloser: out.Body, mirror: m, req: mreq}
+}
+
+// 复制读取到的body,读到EOF后将影子请求放入队列
+type proxyMirrorBody struct {
+	io.ReadCloser
+	mirror   *ProxyMirror
+	req      *http.Request
+	mutex    sync.Mutex // Transport可能在其他goroutine中Close
+	buf      bytes.Buffer
+	overflow bool
+	once     sync.Once
+}
+
+func (b *proxyMirrorBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !b.overflow {
+		if int64(b.buf.Len()+n) > b.mirror.config.BodyLimit {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		b.finish(true)
+	}
+	return
+}
+
+func (b *proxyMirrorBody) Close() error {
+	b.mutex.Lock()
+	b.finish(false)
+	b.mutex.Unlock()
+	return b.ReadCloser.Close()
+}
+
+// 需持有b.mutex
+func (b *proxyMirrorBody) finish(eof bool) {
+	b.once.Do(func() {
+		if b.overflow || (!eof && int64(b.buf.Len()) != b.req.ContentLength) {
+			atomic.AddInt64(&b.mirror.skipped, 1)
+			return
+		}
+		if body := b.buf.Bytes(); len(body) > 0 {
+			b.req.ContentLength = int64(len(body))
+			b.req.Body = ioutil.NopCloser(bytes.NewReader(body))
+			b.req.GetBody = func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(body)), nil
+			}
+		} else {
+			b.req.ContentLength = 0
+		}
+		b.mirror.enqueue(b.req)
+	})
+}
+
+// 逐跳的请求头,同httputil.ReverseProxy
+var proxyHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeProxyHopHeaders(h http.Header) {
+	for _, f := range h["Connection"] {
+		for _, sf := range strings.Split(f, ",") {
+			if sf = textproto.TrimString(sf); sf != "" {
+				h.Del(sf)
+			}
+		}
+	}
+	for _, k := range proxyHopHeaders {
+		h.Del(k)
+	}
+}
+
+// 同httputil.ReverseProxy: 追加客户端地址,X-Forwarded-For被设为nil时不添加
+func setProxyForwardedFor(req *http.Request) {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return
+	}
+	prior, ok := req.Header["X-Forwarded-For"]
+	if ok && prior == nil {
+		return
+	}
+	if len(prior) > 0 {
+		ip = strings.Join(prior, ", ") + ", " + ip
+	}
+	req.Header.Set("X-Forwarded-For", ip)
+}
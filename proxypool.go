@@ -0,0 +1,281 @@
+package kit
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	ProxyBalance_RoundRobin = "roundrobin" // 轮询(默认)
+	ProxyBalance_Weighted   = "weighted"   // 平滑加权轮询
+	ProxyBalance_LeastConn  = "leastconn"  // 最少进行中请求
+	ProxyBalance_Hash       = "hash"       // 按hashKey一致性哈希
+
+	ProxyHashKey_IP = "ip" // 按客户端IP哈希,其余格式为header:<name>或cookie:<name>
+
+	PROXY_HASH_REPLICAS = 160 // 一致性哈希中每单位权重的虚拟节点数
+)
+
+var ErrProxyNoUpstream = errors.New("proxy error: no available upstream")
+
+// 上游节点,由ProxyPool维护
+type proxyUpstream struct {
+	active    int64 // 进行中的请求数,atomic操作,放在开头保证对齐
+	unhealthy int32 // 健康检查结果,atomic操作
+	url       string
+	target    *url.URL
+	weight    int
+	current   int // 平滑加权轮询的当前权重,由ProxyPool.mutex保护
+	health    proxyHealth
+}
+
+type proxyHashNode struct {
+	hash     uint32
+	upstream *proxyUpstream
+}
+
+/*
+多个上游之间负载均衡的反向代理:
+1. balance见ProxyBalance_*常量,hash时按hashKey取值,取不到值时退化为轮询
+2. 默认将入站路径拼接到上游地址路径之后(WithProxyPathJoin),可通过opts覆盖
+3. 上游可在运行期通过Add/Remove动态增删
+4. 开启HealthCheck后跳过不健康的上游,全部不健康时返回错误
+5. 开启Retry后失败的幂等请求在其他上游重试
+*/
+type ProxyPool struct {
+	balance   string
+	hashKey   string
+	options   *proxyOptions
+	proxy     *httputil.ReverseProxy
+	retry     *ProxyRetry
+	budget    *proxyRetryBudget
+	next      uint64
+	mutex     sync.RWMutex
+	upstreams []*proxyUpstream
+	ring      []proxyHashNode
+}
+
+func NewProxyPool(balance string, hashKey string, opts ...ProxyOption) *ProxyPool {
+	switch balance {
+	case "":
+		balance = ProxyBalance_RoundRobin
+	case ProxyBalance_RoundRobin, ProxyBalance_Weighted, ProxyBalance_LeastConn:
+	case ProxyBalance_Hash:
+		if !isProxyKey(hashKey) {
+			panic("invalid proxy hash key: " + hashKey)
+		}
+	default:
+		panic("invalid proxy balance type: " + balance)
+	}
+	o := newProxyOptions(append([]ProxyOption{WithProxyPathJoin()}, opts...)...)
+	return &ProxyPool{
+		balance: balance,
+		hashKey: hashKey,
+		options: o,
+		proxy:   newProxyHandler(o, nil),
+	}
+}
+
+// 添加上游,已存在时更新权重. weight小于等于0时按1处理
+func (p *ProxyPool) Add(rurl string, weight int) error {
+	target, err := url.Parse(rurl)
+	if err != nil {
+		return err
+	}
+	if weight <= 0 {
+		weight = 1
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, u := range p.upstreams {
+		if u.url == rurl {
+			u.weight = weight
+			p.rebuild()
+			return nil
+		}
+	}
+	p.upstreams = append(p.upstreams, &proxyUpstream{url: rurl, target: target, weight: weight})
+	p.rebuild()
+	return nil
+}
+
+// 移除上游,进行中的请求不受影响
+func (p *ProxyPool) Remove(rurl string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for i, u := range p.upstreams {
+		if u.url == rurl {
+			ups := make([]*proxyUpstream, 0, len(p.upstreams)-1)
+			ups = append(ups, p.upstreams[:i]...)
+			p.upstreams = append(ups, p.upstreams[i+1:]...)
+			p.rebuild()
+			return true
+		}
+	}
+	return false
+}
+
+// 返回当前所有上游地址
+func (p *ProxyPool) Upstreams() []string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	rets := make([]string, len(p.upstreams))
+	for i, u := range p.upstreams {
+		rets[i] = u.url
+	}
+	return rets
+}
+
+// 重建一致性哈希环,需持有写锁
+func (p *ProxyPool) rebuild() {
+	if p.balance != ProxyBalance_Hash {
+		return
+	}
+	ring := make([]proxyHashNode, 0, len(p.upstreams)*PROXY_HASH_REPLICAS)
+	for _, u := range p.upstreams {
+		for i, n := 0, u.weight*PROXY_HASH_REPLICAS; i < n; i++ {
+			ring = append(ring, proxyHashNode{hash: MMHash32([]byte(u.url + "#" + strconv.Itoa(i))), upstream: u})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+	p.ring = ring
+}
+
+func (p *ProxyPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u := p.pick(r)
+	if u == nil {
+		httpDynamicErrorHandler(w, r, ErrProxyNoUpstream)
+		return
+	}
+	atomic.AddInt64(&u.active, 1)
+	var st *proxyRetryState
+	if p.retry != nil {
+		r, st = p.prepareRetry(r, u)
+	}
+	p.proxy.ServeHTTP(w, WithProxyTarget(r, u.target))
+	if st != nil {
+		u = st.current // 重试后当前的上游
+	}
+	atomic.AddInt64(&u.active, -1)
+}
+
+func (p *ProxyPool) pick(r *http.Request) *proxyUpstream {
+	switch p.balance {
+	case ProxyBalance_Weighted:
+		return p.pickWeighted()
+	case ProxyBalance_LeastConn:
+		return p.pickLeastConn()
+	case ProxyBalance_Hash:
+		if key := proxyKeyValue(p.hashKey, r); key != "" {
+			return p.pickHash(key)
+		}
+	}
+	return p.pickRoundRobin()
+}
+
+func (p *ProxyPool) pickRoundRobin() *proxyUpstream {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	n := len(p.upstreams)
+	if n == 0 {
+		return nil
+	}
+	start := int(atomic.AddUint64(&p.next, 1) % uint64(n))
+	for i := 0; i < n; i++ {
+		if u := p.upstreams[(start+i)%n]; u.isHealthy() {
+			return u
+		}
+	}
+	return nil
+}
+
+// nginx的平滑加权轮询
+func (p *ProxyPool) pickWeighted() (best *proxyUpstream) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	total := 0
+	for _, u := range p.upstreams {
+		if !u.isHealthy() {
+			continue
+		}
+		u.current += u.weight
+		total += u.weight
+		if best == nil || u.current > best.current {
+			best = u
+		}
+	}
+	if best != nil {
+		best.current -= total
+	}
+	return
+}
+
+// 按active/weight最小选择,相同时从轮询位置开始取第一个以免总是集中到首个节点
+func (p *ProxyPool) pickLeastConn() (best *proxyUpstream) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	n := len(p.upstreams)
+	if n == 0 {
+		return nil
+	}
+	start := int(atomic.AddUint64(&p.next, 1) % uint64(n))
+	var bestLoad float64
+	for i := 0; i < n; i++ {
+		u := p.upstreams[(start+i)%n]
+		if !u.isHealthy() {
+			continue
+		}
+		load := float64(atomic.LoadInt64(&u.active)) / float64(u.weight)
+		if best == nil || load < bestLoad {
+			best, bestLoad = u, load
+		}
+	}
+	return
+}
+
+func (p *ProxyPool) pickHash(key string) *proxyUpstream {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if len(p.ring) == 0 {
+		return nil
+	}
+	h := MMHash32([]byte(key))
+	i := sort.Search(len(p.ring), func(i int) bool {
+		return p.ring[i].hash >= h
+	})
+	// 沿环顺时针找到第一个健康的上游
+	for j, n := 0, len(p.ring); j < n; j++ {
+		if u := p.ring[(i+j)%n].upstream; u.isHealthy() {
+			return u
+		}
+	}
+	return nil
+}
+
+func isProxyKey(key string) bool {
+	return key == ProxyHashKey_IP || strings.HasPrefix(key, "header:") || strings.HasPrefix(key, "cookie:")
+}
+
+// 按ip,header:<name>或cookie:<name>从请求中取值,取不到时返回空字符串
+func proxyKeyValue(key string, r *http.Request) string {
+	switch {
+	case key == ProxyHashKey_IP:
+		return currentHttp().forwarding.clientIP(r)
+	case strings.HasPrefix(key, "header:"):
+		return r.Header.Get(key[len("header:"):])
+	case strings.HasPrefix(key, "cookie:"):
+		if c, err := r.Cookie(key[len("cookie:"):]); err == nil {
+			return c.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,264 @@
+package kit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProxyPool(t *testing.T) {
+	var urls []string
+	for i := 0; i < 3; i++ {
+		srv := httptest.NewServer(http.HandlerFunc(func(i int) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, "%d%s", i, r.URL.Path)
+			}
+		}(i)))
+		defer srv.Close()
+		urls = append(urls, srv.URL)
+	}
+
+	serve := func(p *ProxyPool, r *http.Request) string {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	// 轮询且拼接路径
+	p := NewProxyPool(ProxyBalance_RoundRobin, "")
+	for _, u := range urls {
+		p.Add(u, 1)
+	}
+	counts := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		counts[serve(p, httptest.NewRequest(http.MethodGet, "/x", nil))]++
+	}
+	if counts["0/x"] != 10 || counts["1/x"] != 10 || counts["2/x"] != 10 {
+		t.Fatalf("unexpected round robin distribution: %v", counts)
+	}
+
+	// 加权
+	p = NewProxyPool(ProxyBalance_Weighted, "")
+	p.Add(urls[0], 3)
+	p.Add(urls[1], 1)
+	counts = make(map[string]int)
+	for i := 0; i < 40; i++ {
+		counts[serve(p, httptest.NewRequest(http.MethodGet, "/", nil))]++
+	}
+	if counts["0/"] != 30 || counts["1/"] != 10 {
+		t.Fatalf("unexpected weighted distribution: %v", counts)
+	}
+
+	// 一致性哈希: 同一key总是命中同一上游,移除其他上游不影响
+	p = NewProxyPool(ProxyBalance_Hash, "header:X-User")
+	for _, u := range urls {
+		p.Add(u, 1)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-User", "alice")
+	first := serve(p, r)
+	for i := 0; i < 5; i++ {
+		if got := serve(p, r); got != first {
+			t.Fatalf("hash not sticky: %s vs %s", first, got)
+		}
+	}
+	for i, u := range urls {
+		if fmt.Sprintf("%d/", i) != first {
+			p.Remove(u)
+			break
+		}
+	}
+	if got := serve(p, r); got != first {
+		t.Fatalf("hash moved after removing another upstream: %s vs %s", first, got)
+	}
+
+	// 没有上游
+	p = NewProxyPool(ProxyBalance_LeastConn, "")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502 without upstream, got %d", w.Code)
+	}
+}
+
+func TestProxyPoolHealthCheck(t *testing.T) {
+	var down int32 = 1
+	var urls []string
+	for i := 0; i < 2; i++ {
+		srv := httptest.NewServer(http.HandlerFunc(func(i int) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/health" && i == 1 && atomic.LoadInt32(&down) == 1 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				fmt.Fprintf(w, "%d", i)
+			}
+		}(i)))
+		defer srv.Close()
+		urls = append(urls, srv.URL)
+	}
+	p := NewProxyPool(ProxyBalance_RoundRobin, "")
+	for _, u := range urls {
+		p.Add(u, 1)
+	}
+	stop := p.HealthCheck(ProxyHealthCheck{Path: "/health", Interval: 10 * time.Millisecond, Rise: 1, Fall: 1})
+	defer stop()
+
+	waitHealthy := func(healthy bool) {
+		for i := 0; i < 100; i++ {
+			if st := p.Status(); st[1].Healthy == healthy && !st[1].LastCheck.IsZero() {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("upstream never became healthy=%v: %+v", healthy, p.Status())
+	}
+
+	waitHealthy(false)
+	if st := p.Status(); st[1].LastError == "" || !st[0].Healthy {
+		t.Fatalf("unexpected status: %+v", st)
+	}
+	for i := 0; i < 10; i++ {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Body.String() != "0" {
+			t.Fatalf("request routed to unhealthy upstream: %q", w.Body.String())
+		}
+	}
+
+	atomic.StoreInt32(&down, 0)
+	waitHealthy(true)
+	counts := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		counts[w.Body.String()]++
+	}
+	if counts["0"] != 5 || counts["1"] != 5 {
+		t.Fatalf("recovered upstream not back in rotation: %v", counts)
+	}
+}
+
+func TestProxyPoolRetry(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	var busyHits int32
+	busy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&busyHits, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer busy.Close()
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "ok %s %s", r.URL.Path, body)
+	}))
+	defer ok.Close()
+
+	p := NewProxyPool(ProxyBalance_RoundRobin, "")
+	p.Add(dead.URL, 1)
+	p.Add(busy.URL, 1)
+	p.Add(ok.URL, 1)
+	p.Retry(ProxyRetry{Attempts: 2, MinRetries: 100})
+
+	for i := 0; i < 10; i++ {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/x", strings.NewReader("data")))
+		if w.Code != http.StatusOK || w.Body.String() != "ok /x data" {
+			t.Fatalf("retry failed: %d %q", w.Code, w.Body.String())
+		}
+	}
+	for _, st := range p.Status() {
+		if st.Active != 0 {
+			t.Fatalf("active not released: %+v", st)
+		}
+	}
+
+	// 非幂等请求不重试
+	fails := 0
+	for i := 0; i < 9; i++ {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/x", strings.NewReader("data")))
+		if w.Code != http.StatusOK {
+			fails++
+		}
+	}
+	if fails != 6 {
+		t.Fatalf("expected 6 failed POST without retry, got %d", fails)
+	}
+
+	// 重试额度耗尽后不再重试
+	p = NewProxyPool(ProxyBalance_RoundRobin, "")
+	p.Add(busy.URL, 1)
+	p.Add(busy.URL+"/", 1)
+	p.Retry(ProxyRetry{Budget: 0.01, MinRetries: 1})
+	atomic.StoreInt32(&busyHits, 0)
+	for i := 0; i < 10; i++ {
+		p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	if n := atomic.LoadInt32(&busyHits); n != 11 {
+		t.Fatalf("expected 10 requests and 1 retry, got %d", n)
+	}
+}
+
+func TestProxySplit(t *testing.T) {
+	group := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		})
+	}
+	s := NewProxySplit("header:X-User", "cookie:version")
+	s.Add("stable", group("stable"), 90)
+	s.Add("canary", group("canary"), 10)
+
+	serve := func(user string, version string) string {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if user != "" {
+			r.Header.Set("X-User", user)
+		}
+		if version != "" {
+			r.AddCookie(&http.Cookie{Name: "version", Value: version})
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	assigned := make(map[string]string)
+	canary := 0
+	for i := 0; i < 1000; i++ {
+		user := fmt.Sprintf("user%d", i)
+		assigned[user] = serve(user, "")
+		if assigned[user] == "canary" {
+			canary++
+		}
+	}
+	if canary < 50 || canary > 150 {
+		t.Fatalf("expected about 10%% canary, got %d", canary)
+	}
+	for user, group := range assigned {
+		if got := serve(user, ""); got != group {
+			t.Fatalf("user %s flapped from %s to %s", user, group, got)
+		}
+	}
+
+	// 提高灰度比例时原灰度用户保持不变
+	s.SetWeight("canary", 30)
+	for user, group := range assigned {
+		if group == "canary" && serve(user, "") != "canary" {
+			t.Fatalf("canary user %s moved back after raising weight", user)
+		}
+	}
+
+	s.SetWeight("canary", 0)
+	if serve("user1", "") != "stable" || serve("user1", "canary") != "canary" {
+		t.Fatal("select cookie should reach a group without weight")
+	}
+	if w := s.Weights(); w["stable"] != 90 || w["canary"] != 0 {
+		t.Fatalf("unexpected weights: %v", w)
+	}
+}
@@ -0,0 +1,235 @@
+package kit
+
+import (
+	"container/list"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	ProxyRateLimit_Token  = "token"  // 令牌桶(默认),允许Burst的突发
+	ProxyRateLimit_Window = "window" // 滑动窗口,按前后两个固定窗口加权估算
+
+	ProxyRateKey_Route = "route" // 所有客户端共享同一个额度,其余格式同ProxyPool的hashKey
+
+	PROXY_RATE_PERIOD      = time.Second
+	PROXY_RATE_MAX_KEYS    = 10000
+	PROXY_RATE_EVICT_BATCH = 64 // 达到MaxKeys时每次最多淘汰的空闲key数
+)
+
+/*
+入站请求的限流,每Period最多Rate个请求:
+1. Key为ip(默认),header:<name>(如API key),cookie:<name>或route,取不到值时按空字符串共享额度
+2. ip为客户端地址,来自proxyTrustedCIDRs中的代理时取X-Forwarded-For中的地址
+3. 超过时返回429及Retry-After,所有响应都带X-RateLimit-Limit/Remaining/Reset,令牌桶的Limit为Burst
+4. 最多记录MaxKeys个key的状态,按最近使用淘汰已恢复全部额度的key,没有可淘汰的key时新key共享同一个额度
+*/
+type ProxyRateLimit struct {
+	Algorithm string        `json:"algorithm" yaml:"algorithm"`
+	Rate      int           `json:"rate" yaml:"rate"`
+	Period    time.Duration `json:"period" yaml:"period"`
+	Burst     int           `json:"burst" yaml:"burst"` // 令牌桶容量,默认为Rate
+	Key       string        `json:"key" yaml:"key"`
+	MaxKeys   int           `json:"maxKeys" yaml:"maxKeys"`
+}
+
+type proxyRateState struct {
+	key    string
+	seen   time.Time // 最近一次请求的时间
+	last   time.Time // 令牌桶: 上次补充时间; 滑动窗口: 当前窗口的开始时间
+	tokens float64   // 令牌桶: 剩余令牌
+	prev   int       // 滑动窗口: 上个窗口的请求数
+	curr   int       // 滑动窗口: 当前窗口的请求数
+}
+
+type ProxyRateLimiter struct {
+	config   ProxyRateLimit
+	mutex    sync.Mutex
+	states   map[string]*list.Element // key => *proxyRateState
+	lru      *list.List               // 最近使用的在前
+	overflow *proxyRateState          // 超过MaxKeys且没有可淘汰的key时共享
+	now      func() time.Time
+}
+
+// 配置非法时panic
+func NewProxyRateLimiter(c ProxyRateLimit) *ProxyRateLimiter {
+	switch c.Algorithm {
+	case "":
+		c.Algorithm = ProxyRateLimit_Token
+	case ProxyRateLimit_Token, ProxyRateLimit_Window:
+	default:
+		panic("invalid proxy rate limit algorithm: " + c.Algorithm)
+	}
+	if c.Rate <= 0 {
+		panic("invalid proxy rate limit rate: " + strconv.Itoa(c.Rate))
+	}
+	if c.Period <= 0 {
+		c.Period = PROXY_RATE_PERIOD
+	}
+	if c.Burst <= 0 {
+		c.Burst = c.Rate
+	}
+	if c.Key == "" {
+		c.Key = ProxyHashKey_IP
+	} else if c.Key != ProxyRateKey_Route && !isProxyKey(c.Key) {
+		panic("invalid proxy rate limit key: " + c.Key)
+	}
+	if c.MaxKeys <= 0 {
+		c.MaxKeys = PROXY_RATE_MAX_KEYS
+	}
+	return &ProxyRateLimiter{
+		config: c,
+		states: make(map[string]*list.Element),
+		lru:    list.New(),
+		now:    time.Now,
+	}
+}
+
+/*
+检查请求是否超过限制,未超过返回true. 超过时已写入429响应,调用方直接返回即可:
+
+	if !limiter.Check(w, r) {
+		return
+	}
+	kit.HttpProxy(target, w, r)
+*/
+func (l *ProxyRateLimiter) Check(w http.ResponseWriter, r *http.Request) bool {
+	var key string
+	if l.config.Key != ProxyRateKey_Route {
+		key = proxyKeyValue(l.config.Key, r)
+	}
+	ok, remaining, reset, retry := l.allow(key)
+	limit := l.config.Rate
+	if l.config.Algorithm == ProxyRateLimit_Token {
+		limit = l.config.Burst // 令牌桶最多允许Burst个请求
+	}
+	h := w.Header()
+	h.Set("X-RateLimit-Limit", strconv.Itoa(limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(ceilSeconds(reset), 10))
+	if !ok {
+		h.Set("Retry-After", strconv.FormatInt(ceilSeconds(retry), 10))
+		w.WriteHeader(http.StatusTooManyRequests)
+	}
+	return ok
+}
+
+// 在next之前限流
+func (l *ProxyRateLimiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.Check(w, r) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func ceilSeconds(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64(math.Ceil(d.Seconds()))
+}
+
+/*
+返回是否允许,剩余请求数,额度完全恢复(令牌桶)或当前窗口结束(滑动窗口)的时间,
+以及被拒绝时需要等待的时间
+*/
+func (l *ProxyRateLimiter) allow(key string) (ok bool, remaining int, reset time.Duration, retry time.Duration) {
+	now := l.now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var st *proxyRateState
+	if e := l.states[key]; e != nil {
+		l.lru.MoveToFront(e)
+		st = e.Value.(*proxyRateState)
+	} else {
+		if len(l.states) >= l.config.MaxKeys {
+			l.evict(now)
+		}
+		if len(l.states) < l.config.MaxKeys {
+			st = l.newState(key, now)
+			l.states[key] = l.lru.PushFront(st)
+		} else {
+			if l.overflow == nil {
+				l.overflow = l.newState("", now)
+			}
+			st = l.overflow
+		}
+	}
+	st.seen = now
+	if l.config.Algorithm == ProxyRateLimit_Window {
+		return l.allowWindow(st, now)
+	}
+	return l.allowToken(st, now)
+}
+
+func (l *ProxyRateLimiter) allowToken(st *proxyRateState, now time.Time) (ok bool, remaining int, reset time.Duration, retry time.Duration) {
+	rate := float64(l.config.Rate) / float64(l.config.Period) // 每纳秒的令牌数
+	burst := float64(l.config.Burst)
+	if st.tokens += float64(now.Sub(st.last)) * rate; st.tokens > burst {
+		st.tokens = burst
+	}
+	st.last = now
+	if st.tokens >= 1 {
+		st.tokens--
+		ok = true
+	} else {
+		retry = time.Duration((1 - st.tokens) / rate)
+	}
+	return ok, int(st.tokens), time.Duration((burst - st.tokens) / rate), retry
+}
+
+func (l *ProxyRateLimiter) allowWindow(st *proxyRateState, now time.Time) (ok bool, remaining int, reset time.Duration, retry time.Duration) {
+	period := l.config.Period
+	if elapsed := now.Sub(st.last); elapsed >= 2*period {
+		st.prev, st.curr, st.last = 0, 0, now
+	} else if elapsed >= period {
+		st.prev, st.curr, st.last = st.curr, 0, st.last.Add(period)
+	}
+	elapsed := now.Sub(st.last)
+	rate := float64(l.config.Rate)
+	// 上个窗口在滑动窗口内的部分按比例计入
+	count := float64(st.prev)*(1-float64(elapsed)/float64(period)) + float64(st.curr)
+	if count+1 <= rate {
+		st.curr++
+		count++
+		ok = true
+	} else if st.curr < l.config.Rate && st.prev > 0 {
+		// 等待上个窗口的计数滑出足够多
+		retry = time.Duration(float64(period)*(1-(rate-1-float64(st.curr))/float64(st.prev))) - elapsed
+	} else {
+		// 本窗口已满,需等到下个窗口中本窗口的计数滑出足够多
+		retry = period - elapsed + time.Duration(float64(period)*(1-(rate-1)/float64(st.curr)))
+	}
+	return ok, int(math.Max(0, rate-count)), period - elapsed, retry
+}
+
+func (l *ProxyRateLimiter) newState(key string, now time.Time) *proxyRateState {
+	return &proxyRateState{key: key, seen: now, last: now, tokens: float64(l.config.Burst)}
+}
+
+/*
+从最久未使用的一端淘汰已恢复全部额度的key,淘汰后与新key的状态相同,不影响限流.
+最久未使用的key仍未恢复时其他key也不会恢复,因此每次至多检查PROXY_RATE_EVICT_BATCH个. 需持有l.mutex
+*/
+func (l *ProxyRateLimiter) evict(now time.Time) {
+	idle := 2 * l.config.Period
+	if l.config.Algorithm == ProxyRateLimit_Token {
+		idle = time.Duration(float64(l.config.Period) * float64(l.config.Burst) / float64(l.config.Rate))
+	}
+	for i := 0; i < PROXY_RATE_EVICT_BATCH; i++ {
+		e := l.lru.Back()
+		if e == nil {
+			return
+		}
+		st := e.Value.(*proxyRateState)
+		if now.Sub(st.seen) < idle {
+			return
+		}
+		l.lru.Remove(e)
+		delete(l.states, st.key)
+	}
+}
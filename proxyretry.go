@@ -0,0 +1,221 @@
+package kit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	PROXY_RETRY_ATTEMPTS    = 1         // 默认最多重试1次
+	PROXY_RETRY_BODY_LIMIT  = 64 * 1024 // 默认缓存64K以内的请求body用于重放
+	PROXY_RETRY_BUDGET      = 0.2       // 默认重试数不超过请求数的20%
+	PROXY_RETRY_MIN_RETRIES = 10        // 默认预留的重试额度
+)
+
+/*
+ProxyPool的失败重试:
+1. 仅重试幂等请求(GET,HEAD,OPTIONS,TRACE,PUT,DELETE或带Idempotency-Key请求头)
+2. 拨号失败,或上游返回502/503时换下一个健康的上游重试,此时响应尚未写给客户端
+3. body不超过BodyLimit时缓存用于重放,超过时不重试
+4. 每个请求为重试额度增加Budget,每次重试消耗1,额度上限为MinRetries,避免故障时放大流量
+*/
+type ProxyRetry struct {
+	Attempts   int     `json:"attempts" yaml:"attempts"`
+	BodyLimit  int64   `json:"bodyLimit" yaml:"bodyLimit"`
+	Budget     float64 `json:"budget" yaml:"budget"`
+	MinRetries int     `json:"minRetries" yaml:"minRetries"`
+}
+
+func (r ProxyRetry) fill() ProxyRetry {
+	if r.Attempts <= 0 {
+		r.Attempts = PROXY_RETRY_ATTEMPTS
+	}
+	if r.BodyLimit <= 0 {
+		r.BodyLimit = PROXY_RETRY_BODY_LIMIT
+	}
+	if r.Budget <= 0 {
+		r.Budget = PROXY_RETRY_BUDGET
+	}
+	if r.MinRetries <= 0 {
+		r.MinRetries = PROXY_RETRY_MIN_RETRIES
+	}
+	return r
+}
+
+type proxyRetryBudget struct {
+	mutex  sync.Mutex
+	ratio  float64
+	max    float64
+	tokens float64
+}
+
+func newProxyRetryBudget(r *ProxyRetry) *proxyRetryBudget {
+	return &proxyRetryBudget{
+		ratio:  r.Budget,
+		max:    float64(r.MinRetries),
+		tokens: float64(r.MinRetries),
+	}
+}
+
+func (b *proxyRetryBudget) deposit() {
+	b.mutex.Lock()
+	if b.tokens += b.ratio; b.tokens > b.max {
+		b.tokens = b.max
+	}
+	b.mutex.Unlock()
+}
+
+func (b *proxyRetryBudget) withdraw() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+type proxyRetryKey struct{}
+
+// 单个请求的重试状态,仅在该请求的处理过程中使用
+type proxyRetryState struct {
+	inbound  url.URL // Director改写前的入站URL
+	host     string
+	body     []byte
+	attempts int
+	current  *proxyUpstream
+	tried    []*proxyUpstream
+}
+
+// 开启失败重试,需在处理请求前调用
+func (p *ProxyPool) Retry(r ProxyRetry) {
+	r = r.fill()
+	p.retry = &r
+	p.budget = newProxyRetryBudget(&r)
+	p.proxy.Transport = proxyRetryTransport{pool: p}
+}
+
+func isProxyIdempotent(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	// 同net/http对Idempotency-Key的处理
+	if _, ok := r.Header["Idempotency-Key"]; ok {
+		return true
+	}
+	_, ok := r.Header["X-Idempotency-Key"]
+	return ok
+}
+
+// 为可重试的请求准备重试状态,body超过限制时返回nil并保持body可完整读取
+func (p *ProxyPool) prepareRetry(r *http.Request, u *proxyUpstream) (*http.Request, *proxyRetryState) {
+	p.budget.deposit()
+	if !isProxyIdempotent(r) {
+		return r, nil
+	}
+	st := &proxyRetryState{
+		inbound:  *r.URL,
+		host:     r.Host,
+		attempts: p.retry.Attempts,
+		current:  u,
+		tried:    []*proxyUpstream{u},
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		if r.ContentLength > p.retry.BodyLimit {
+			return r, nil
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, p.retry.BodyLimit+1))
+		if err != nil || int64(len(body)) > p.retry.BodyLimit {
+			r.Body = proxyReplayBody{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+			return r, nil
+		}
+		r.Body.Close()
+		st.body = body
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	return r.WithContext(context.WithValue(r.Context(), proxyRetryKey{}, st)), st
+}
+
+type proxyReplayBody struct {
+	io.Reader
+	io.Closer
+}
+
+// 从未尝试过的健康上游中按轮询顺序选择下一个
+func (p *ProxyPool) pickRetry(tried []*proxyUpstream) *proxyUpstream {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	n := len(p.upstreams)
+	if n == 0 {
+		return nil
+	}
+	start := int(atomic.AddUint64(&p.next, 1) % uint64(n))
+NEXT:
+	for i := 0; i < n; i++ {
+		u := p.upstreams[(start+i)%n]
+		if !u.isHealthy() {
+			continue
+		}
+		for _, t := range tried {
+			if t == u {
+				continue NEXT
+			}
+		}
+		return u
+	}
+	return nil
+}
+
+func shouldProxyRetry(rsp *http.Response, err error) bool {
+	if err != nil {
+		var oe *net.OpError
+		return errors.As(err, &oe) && oe.Op == "dial"
+	}
+	return rsp.StatusCode == http.StatusBadGateway || rsp.StatusCode == http.StatusServiceUnavailable
+}
+
+type proxyRetryTransport struct {
+	pool *ProxyPool
+}
+
+func (t proxyRetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rsp, err := httpDynamicProxyTransport{}.RoundTrip(req)
+	st, _ := req.Context().Value(proxyRetryKey{}).(*proxyRetryState)
+	if st == nil {
+		return rsp, err
+	}
+	for ; st.attempts > 0 && shouldProxyRetry(rsp, err) && req.Context().Err() == nil; st.attempts-- {
+		next := t.pool.pickRetry(st.tried)
+		if next == nil || !t.pool.budget.withdraw() {
+			break
+		}
+		if rsp != nil {
+			io.Copy(ioutil.Discard, rsp.Body)
+			rsp.Body.Close()
+		}
+		atomic.AddInt64(&next.active, 1)
+		atomic.AddInt64(&st.current.active, -1)
+		st.current = next
+		st.tried = append(st.tried, next)
+
+		retry := req.Clone(req.Context())
+		retry.URL = new(url.URL)
+		*retry.URL = st.inbound
+		retry.Host = st.host
+		proxyOptionsOf(req, t.pool.options).retarget(retry, next.target)
+		if req.Body != nil && st.body != nil {
+			retry.Body = ioutil.NopCloser(bytes.NewReader(st.body))
+		}
+		rsp, err = httpDynamicProxyTransport{}.RoundTrip(retry)
+	}
+	return rsp, err
+}
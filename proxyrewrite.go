@@ -0,0 +1,262 @@
+package kit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	PROXY_REWRITE_CHUNK_SIZE = 32 * 1024
+	PROXY_INJECT_JSON_LIMIT  = 1024 * 1024 // ProxyInjectJson最多读取的body大小,超过时原样转发
+)
+
+/*
+改写代理响应的body,返回的Reader替换原body.
+body已按Content-Encoding解压,返回*bytes.Reader时会设置准确的Content-Length,否则改为chunked
+*/
+type ProxyBodyRewriter func(rsp *http.Response, body io.Reader) io.Reader
+
+/*
+按顺序用rewriters改写响应body:
+1. 只处理未压缩或gzip的响应,gzip时解压改写后重新压缩
+2. HEAD请求,1xx/204/206/304响应及空的gzip响应不处理
+3. 改写后强ETag改为弱ETag,body不再与上游的表示字节一致
+*/
+func WithProxyBodyRewrite(rewriters ...ProxyBodyRewriter) ProxyOption {
+	return func(o *proxyOptions) {
+		o.bodyRewriters = append(o.bodyRewriters, rewriters...)
+	}
+}
+
+func rewriteProxyBody(rsp *http.Response, rewriters []ProxyBodyRewriter) error {
+	if rsp.Request != nil && rsp.Request.Method == http.MethodHead {
+		return nil
+	}
+	switch {
+	case rsp.StatusCode < 200, rsp.StatusCode == http.StatusNoContent,
+		rsp.StatusCode == http.StatusPartialContent, rsp.StatusCode == http.StatusNotModified:
+		return nil
+	}
+	var body io.Reader = rsp.Body
+	encoding := strings.ToLower(strings.TrimSpace(rsp.Header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(rsp.Body)
+		if err == io.EOF {
+			return nil // 空body,如Content-Length: 0的200
+		}
+		if err != nil {
+			return err
+		}
+		body = zr
+	default:
+		return nil
+	}
+	for _, rewrite := range rewriters {
+		body = rewrite(rsp, body)
+	}
+	if encoding == "gzip" {
+		pr, pw := io.Pipe()
+		go func(src io.Reader) {
+			zw := gzip.NewWriter(pw)
+			_, err := io.Copy(zw, src)
+			if cerr := zw.Close(); err == nil {
+				err = cerr
+			}
+			pw.CloseWithError(err)
+		}(body)
+		body = pr
+	}
+	rsp.Body = proxyRewriteBody{Reader: body, src: rsp.Body}
+	if etag := rsp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		rsp.Header.Set("ETag", "W/"+etag)
+	}
+	if br, ok := body.(*bytes.Reader); ok {
+		rsp.ContentLength = int64(br.Len())
+		rsp.Header.Set("Content-Length", strconv.FormatInt(rsp.ContentLength, 10))
+	} else {
+		rsp.ContentLength = -1
+		rsp.Header.Del("Content-Length")
+	}
+	return nil
+}
+
+type proxyRewriteBody struct {
+	io.Reader
+	src io.Closer
+}
+
+func (b proxyRewriteBody) Close() error {
+	if pr, ok := b.Reader.(*io.PipeReader); ok {
+		pr.Close() // 结束压缩goroutine
+	}
+	return b.src.Close()
+}
+
+type proxyErrReader struct {
+	err error
+}
+
+func (r proxyErrReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+// 流式地将body中的old替换为new,old为空时不改写
+func ProxyReplaceBody(old string, new string) ProxyBodyRewriter {
+	return func(rsp *http.Response, body io.Reader) io.Reader {
+		if old == "" {
+			return body
+		}
+		return &proxyReplaceReader{src: body, old: []byte(old), new: []byte(new)}
+	}
+}
+
+type proxyReplaceReader struct {
+	src   io.Reader
+	old   []byte
+	new   []byte
+	buf   []byte // 尚未处理的输入,保留末尾可能与下次输入组成old的部分
+	out   []byte // 已处理待读取的输出
+	chunk []byte // 读取src的缓冲,每个reader只分配一次
+	err   error
+	done  bool
+}
+
+func (r *proxyReplaceReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, r.err
+		}
+		if r.chunk == nil {
+			r.chunk = make([]byte, PROXY_REWRITE_CHUNK_SIZE)
+		}
+		n, err := r.src.Read(r.chunk)
+		r.buf = append(r.buf, r.chunk[:n]...)
+		if err != nil {
+			r.done, r.err = true, err
+		}
+		r.replace()
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *proxyReplaceReader) replace() {
+	var out []byte
+	i := 0
+	for {
+		j := bytes.Index(r.buf[i:], r.old)
+		if j < 0 {
+			break
+		}
+		out = append(out, r.buf[i:i+j]...)
+		out = append(out, r.new...)
+		i += j + len(r.old)
+	}
+	keep := 0
+	if !r.done {
+		if keep = len(r.old) - 1; keep > len(r.buf)-i {
+			keep = len(r.buf) - i
+		}
+	}
+	out = append(out, r.buf[i:len(r.buf)-keep]...)
+	r.buf = append(r.buf[:0:0], r.buf[len(r.buf)-keep:]...)
+	r.out = out
+}
+
+/*
+向json对象响应的顶层注入字段,已存在的字段就地替换,新字段按名称排序追加在末尾.
+原有字段的顺序及数值的原文保持不变. 非json对象或超过PROXY_INJECT_JSON_LIMIT的响应原样转发
+*/
+func ProxyInjectJson(fields map[string]interface{}) ProxyBodyRewriter {
+	return func(rsp *http.Response, body io.Reader) io.Reader {
+		mt, _, _ := mime.ParseMediaType(rsp.Header.Get("Content-Type"))
+		if mt != "application/json" && !strings.HasSuffix(mt, "+json") {
+			return body
+		}
+		if rsp.ContentLength > PROXY_INJECT_JSON_LIMIT && rsp.Header.Get("Content-Encoding") == "" {
+			return body
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(body, PROXY_INJECT_JSON_LIMIT+1))
+		if err != nil {
+			return io.MultiReader(bytes.NewReader(data), proxyErrReader{err})
+		}
+		if len(data) > PROXY_INJECT_JSON_LIMIT {
+			return io.MultiReader(bytes.NewReader(data), body)
+		}
+		if ret, ok := injectJsonFields(data, fields); ok {
+			return bytes.NewReader(ret)
+		}
+		return bytes.NewReader(data)
+	}
+}
+
+func injectJsonFields(data []byte, fields map[string]interface{}) ([]byte, bool) {
+	values := make(map[string]json.RawMessage, len(fields))
+	names := make([]string, 0, len(fields))
+	for k, v := range fields {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return nil, false
+		}
+		values[k] = raw
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, false
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	seen := make(map[string]bool, len(fields))
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, false
+		}
+		key := tok.(string)
+		var raw json.RawMessage
+		if err = dec.Decode(&raw); err != nil {
+			return nil, false
+		}
+		if v, ok := values[key]; ok {
+			raw, seen[key] = v, true
+		}
+		writeJsonMember(&buf, key, raw)
+	}
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('}') {
+		return nil, false
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, false // 对象之后还有其他内容
+	}
+	for _, k := range names {
+		if !seen[k] {
+			writeJsonMember(&buf, k, values[k])
+		}
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), true
+}
+
+func writeJsonMember(buf *bytes.Buffer, key string, raw json.RawMessage) {
+	if buf.Len() > 1 {
+		buf.WriteByte(',')
+	}
+	k, _ := json.Marshal(key)
+	buf.Write(k)
+	buf.WriteByte(':')
+	buf.Write(raw)
+}
@@ -0,0 +1,131 @@
+package kit
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+)
+
+const PROXY_SPLIT_BUCKETS = 10000 // 粘性分配时将key的哈希映射到的桶数
+
+type proxySplitGroup struct {
+	name    string
+	handler http.Handler
+	weight  int
+}
+
+/*
+按权重在多个上游组之间分流,用于灰度发布:
+1. selectKey(header:<name>或cookie:<name>)的值等于组名时直接使用该组,为空表示不支持指定
+2. 否则按stickyKey(格式同ProxyPool的hashKey)的MMHash32落到固定的桶,同一用户在权重不变时总是分到同一组
+3. 取不到stickyKey的值时按权重随机分配
+权重可在运行期通过SetWeight调整,调整后只有落在变化区间内的用户会切换分组
+*/
+type ProxySplit struct {
+	stickyKey string
+	selectKey string
+	mutex     sync.RWMutex
+	groups    []*proxySplitGroup
+}
+
+func NewProxySplit(stickyKey string, selectKey string) *ProxySplit {
+	if stickyKey != "" && !isProxyKey(stickyKey) {
+		panic("invalid proxy sticky key: " + stickyKey)
+	}
+	if selectKey != "" && (selectKey == ProxyHashKey_IP || !isProxyKey(selectKey)) {
+		panic("invalid proxy select key: " + selectKey)
+	}
+	return &ProxySplit{
+		stickyKey: stickyKey,
+		selectKey: selectKey,
+	}
+}
+
+// 添加上游组,handler通常为ProxyPool或HttpProxyHandler. 已存在时替换
+func (s *ProxySplit) Add(name string, handler http.Handler, weight int) {
+	if weight < 0 {
+		weight = 0
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, g := range s.groups {
+		if g.name == name {
+			g.handler, g.weight = handler, weight
+			return
+		}
+	}
+	s.groups = append(s.groups, &proxySplitGroup{name: name, handler: handler, weight: weight})
+}
+
+// 调整组的权重,为0时只能通过selectKey访问. 组不存在时返回false
+func (s *ProxySplit) SetWeight(name string, weight int) bool {
+	if weight < 0 {
+		weight = 0
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, g := range s.groups {
+		if g.name == name {
+			g.weight = weight
+			return true
+		}
+	}
+	return false
+}
+
+// 返回各组当前的权重
+func (s *ProxySplit) Weights() map[string]int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	rets := make(map[string]int, len(s.groups))
+	for _, g := range s.groups {
+		rets[g.name] = g.weight
+	}
+	return rets
+}
+
+func (s *ProxySplit) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h := s.pick(r); h != nil {
+		h.ServeHTTP(w, r)
+		return
+	}
+	httpDynamicErrorHandler(w, r, ErrProxyNoUpstream)
+}
+
+func (s *ProxySplit) pick(r *http.Request) http.Handler {
+	var name string
+	if s.selectKey != "" {
+		name = proxyKeyValue(s.selectKey, r)
+	}
+	var key string
+	if s.stickyKey != "" {
+		key = proxyKeyValue(s.stickyKey, r)
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	total := 0
+	for _, g := range s.groups {
+		if name != "" && g.name == name {
+			return g.handler
+		}
+		total += g.weight
+	}
+	if total == 0 {
+		return nil
+	}
+	var n int
+	if key != "" {
+		// 先映射到固定的桶再按权重比例划分,权重变化时不会打乱所有用户
+		n = int(MMHash32([]byte(key))%PROXY_SPLIT_BUCKETS) * total / PROXY_SPLIT_BUCKETS
+	} else {
+		n = rand.Intn(total)
+	}
+	for _, g := range s.groups {
+		if n < g.weight {
+			return g.handler
+		}
+		n -= g.weight
+	}
+	return nil
+}
@@ -1,6 +1,6 @@
 package kit
 
-import "unsafe"
+import "encoding/binary"
 
 func IfBool(c bool, v1 bool, v2 bool) bool {
 	if c {
@@ -55,14 +55,8 @@ func MMHash32(data []byte) uint32 {
 	var h1 uint32 = 37
 
 	nblocks := len(data) / 4
-	var p uintptr
-	if len(data) > 0 {
-		p = uintptr(unsafe.Pointer(&data[0]))
-	}
-
-	p1 := p + uintptr(4*nblocks)
-	for ; p < p1; p += 4 {
-		k1 := *(*uint32)(unsafe.Pointer(p))
+	for i := 0; i < nblocks*4; i += 4 {
+		k1 := binary.LittleEndian.Uint32(data[i:])
 
 		k1 *= c1_32
 		k1 = (k1 << 15) | (k1 >> 17) // rotl32(k1, 15)